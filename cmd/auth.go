@@ -0,0 +1,413 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// defaultAPIKeyHeader is the header that carries an API key when the configuration does not set one.
+const defaultAPIKeyHeader = "X-API-Key"
+
+// authFailuresMetric counts rejected requests, keyed by API mapping name.
+var authFailuresMetric = expvar.NewMap("auth_failures")
+
+// Key and JWKS files are kept by path and read again when they change.
+var (
+	authFilesMu sync.Mutex
+	authFiles   = make(map[string]authFile)
+)
+
+// authFile is a parsed key or JWKS file.
+type authFile struct {
+	modTime time.Time
+	value   interface{}
+}
+
+// apiKey is an entry of the key file. Hash is the hex SHA-256 of the key.
+type apiKey struct {
+	Hash     string                 `json:"hash"`
+	Consumer string                 `json:"consumer"`
+	Scopes   []string               `json:"scopes,omitempty"`
+	Claims   map[string]interface{} `json:"claims,omitempty"`
+	Disabled bool                   `json:"disabled,omitempty"`
+}
+
+// jsonWebKey is a public key of a JWKS file.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// verificationKey is a parsed JWKS key.
+type verificationKey struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+// authenticate checks the credentials of a request to an API mapping with an auth section
+// and keeps their claims with the request for src:auth. Missing or invalid credentials are
+// answered with 401, credentials without the required scopes with 403, and false is returned.
+func authenticate(w http.ResponseWriter, r *http.Request, endpoint conf.APIEndpoint) bool {
+	auth := endpoint.Auth
+	if auth == nil {
+		return true
+	}
+
+	claims, err := verifyCredentials(r, auth)
+	if err != nil {
+		fmt.Printf("AUTH FAILED: %v\n", err)
+		authFailuresMetric.Add(endpoint.Name, 1)
+		if auth.JWT != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		}
+		if auth.Unauthorized != nil {
+			writeMappedResponse(w, r, *auth.Unauthorized)
+			return false
+		}
+		writeJSONResponse(w, http.StatusUnauthorized, map[string]interface{}{
+			"status":  http.StatusUnauthorized,
+			"code":    "UNAUTHENTICATED",
+			"message": "Request not authenticated due to missing, invalid, or expired credentials.",
+		})
+		return false
+	}
+	getRequestContext(r).authClaims = claims
+	fmt.Printf("AUTHENTICATED: %s\n", claims.Get("sub").String())
+
+	if missing := missingScope(claims, auth.Scopes); missing != "" {
+		fmt.Printf("AUTH FORBIDDEN: scope %s missing\n", missing)
+		authFailuresMetric.Add(endpoint.Name, 1)
+		writeForbiddenResponse(w, r, auth.Forbidden)
+		return false
+	}
+	return true
+}
+
+// writeForbiddenResponse sends the configured 403 response, or a PERMISSION_DENIED JSON body.
+func writeForbiddenResponse(w http.ResponseWriter, r *http.Request, res *conf.Response) {
+	if res != nil {
+		writeMappedResponse(w, r, *res)
+		return
+	}
+	writeJSONResponse(w, http.StatusForbidden, map[string]interface{}{
+		"status":  http.StatusForbidden,
+		"code":    "PERMISSION_DENIED",
+		"message": "Client does not have sufficient permissions to perform this action.",
+	})
+}
+
+// verifyCredentials verifies the API key or bearer token of a request and returns its claims.
+func verifyCredentials(r *http.Request, auth *conf.InboundAuth) (gjson.Result, error) {
+	if auth.APIKey != nil {
+		header := auth.APIKey.Header
+		if header == "" {
+			header = defaultAPIKeyHeader
+		}
+		if key := r.Header.Get(header); key != "" {
+			return verifyAPIKey(key, auth.APIKey.KeyFile)
+		}
+	}
+	if auth.JWT != nil {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			return verifyJWT(strings.TrimSpace(token), auth.JWT)
+		}
+	}
+	return gjson.Result{}, errors.New("no credentials")
+}
+
+// missingScope returns the first required scope the claims do not grant. Scopes are read
+// from the space separated "scope" claim or the "scp" array.
+func missingScope(claims gjson.Result, required []string) string {
+	granted := make(map[string]bool)
+	for _, scope := range strings.Fields(claims.Get("scope").String()) {
+		granted[scope] = true
+	}
+	for _, scope := range claims.Get("scp").Array() {
+		granted[scope.String()] = true
+	}
+	for _, scope := range required {
+		if !granted[scope] {
+			return scope
+		}
+	}
+	return ""
+}
+
+// verifyAPIKey looks an API key up in the key file. Its claims are the entry's claims with
+// the consumer as "sub" and the scopes as "scope".
+func verifyAPIKey(key, keyFile string) (gjson.Result, error) {
+	value, err := readAuthFile(keyFile, parseKeyFile)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	sum := sha256.Sum256([]byte(key))
+	entry, ok := value.(map[string]apiKey)[hex.EncodeToString(sum[:])]
+	if !ok {
+		return gjson.Result{}, errors.New("unknown API key")
+	}
+	if entry.Disabled {
+		return gjson.Result{}, fmt.Errorf("API key of %s is disabled", entry.Consumer)
+	}
+
+	claims := make(map[string]interface{})
+	for name, v := range entry.Claims {
+		claims[name] = v
+	}
+	claims["sub"] = entry.Consumer
+	claims["scope"] = strings.Join(entry.Scopes, " ")
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	return gjson.ParseBytes(data), nil
+}
+
+// verifyJWT verifies the signature of a JWT with the JWKS file, then its expiry, issuer and
+// audience, and returns its claims. RS256, RS384, RS512, ES256 and ES384 are supported.
+func verifyJWT(token string, settings *conf.JWTAuth) (gjson.Result, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return gjson.Result{}, errors.New("malformed token")
+	}
+	header, err := decodeSegment(parts[0])
+	if err != nil || !gjson.ValidBytes(header) {
+		return gjson.Result{}, errors.New("malformed token header")
+	}
+	payload, err := decodeSegment(parts[1])
+	if err != nil || !gjson.ValidBytes(payload) {
+		return gjson.Result{}, errors.New("malformed token payload")
+	}
+	signature, err := decodeSegment(parts[2])
+	if err != nil {
+		return gjson.Result{}, errors.New("malformed token signature")
+	}
+
+	alg := gjson.GetBytes(header, "alg").String()
+	kid := gjson.GetBytes(header, "kid").String()
+	hash, err := jwtHash(alg)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	value, err := readAuthFile(settings.JWKSFile, parseJWKSFile)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	digest := hash.New()
+	digest.Write([]byte(parts[0] + "." + parts[1]))
+	sum := digest.Sum(nil)
+	verified := false
+	for _, key := range value.([]verificationKey) {
+		if (kid != "" && key.kid != kid) || (key.alg != "" && key.alg != alg) {
+			continue
+		}
+		if verifySignature(alg, key.key, hash, sum, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return gjson.Result{}, errors.New("invalid token signature")
+	}
+
+	claims := gjson.ParseBytes(payload)
+	now := time.Now()
+	leeway := settings.Leeway.Duration()
+	exp := claims.Get("exp")
+	if !exp.Exists() {
+		return gjson.Result{}, errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(exp.Int(), 0).Add(leeway)) {
+		return gjson.Result{}, errors.New("token expired")
+	}
+	if nbf := claims.Get("nbf"); nbf.Exists() && now.Before(time.Unix(nbf.Int(), 0).Add(-leeway)) {
+		return gjson.Result{}, errors.New("token not valid yet")
+	}
+	if settings.Issuer != "" && claims.Get("iss").String() != settings.Issuer {
+		return gjson.Result{}, fmt.Errorf("token issuer %s not accepted", claims.Get("iss").String())
+	}
+	if settings.Audience != "" && !hasAudience(claims.Get("aud"), settings.Audience) {
+		return gjson.Result{}, errors.New("token audience not accepted")
+	}
+	return claims, nil
+}
+
+// hasAudience reports whether the aud claim, a string or an array, contains an audience.
+func hasAudience(aud gjson.Result, audience string) bool {
+	if aud.IsArray() {
+		for _, a := range aud.Array() {
+			if a.String() == audience {
+				return true
+			}
+		}
+		return false
+	}
+	return aud.String() == audience
+}
+
+// jwtHash returns the hash function of a JWT signing algorithm.
+func jwtHash(alg string) (crypto.Hash, error) {
+	switch alg {
+	case "RS256", "ES256":
+		return crypto.SHA256, nil
+	case "RS384", "ES384":
+		return crypto.SHA384, nil
+	case "RS512":
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported token algorithm: %s", alg)
+}
+
+// verifySignature verifies a JWT signature with a public key of the algorithm's type.
+func verifySignature(alg string, key crypto.PublicKey, hash crypto.Hash, digest, signature []byte) bool {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size || (alg == "ES256") != (key.Curve == elliptic.P256()) {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+// decodeSegment decodes a base64url segment of a JWT.
+func decodeSegment(segment string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+}
+
+// readAuthFile returns a parsed key or JWKS file, parsing it again when it has changed.
+func readAuthFile(path string, parse func([]byte) (interface{}, error)) (interface{}, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	authFilesMu.Lock()
+	defer authFilesMu.Unlock()
+	if cached, ok := authFiles[path]; ok && cached.modTime.Equal(info.ModTime()) {
+		return cached.value, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	value, err := parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	authFiles[path] = authFile{modTime: info.ModTime(), value: value}
+	return value, nil
+}
+
+// parseKeyFile parses a key file into its entries by hash.
+func parseKeyFile(data []byte) (interface{}, error) {
+	var file struct {
+		Keys []apiKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]apiKey, len(file.Keys))
+	for _, key := range file.Keys {
+		keys[strings.ToLower(key.Hash)] = key
+	}
+	return keys, nil
+}
+
+// parseJWKSFile parses the RSA and EC keys of a JWKS file. Other keys are skipped.
+func parseJWKSFile(data []byte) (interface{}, error) {
+	var file struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	var keys []verificationKey
+	for _, jwk := range file.Keys {
+		key, err := jwk.publicKey()
+		if err != nil {
+			fmt.Printf("Skipping JWKS key %s: %v\n", jwk.Kid, err)
+			continue
+		}
+		keys = append(keys, verificationKey{kid: jwk.Kid, alg: jwk.Alg, key: key})
+	}
+	return keys, nil
+}
+
+// publicKey decodes the public key of a JWK.
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeSegment(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeSegment(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := decodeSegment(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeSegment(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if _, err := key.ECDH(); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", jwk.Kty)
+}
+
+// getAuthClaim returns a claim of the authenticated caller.
+func getAuthClaim(rc *requestContext, key string) interface{} {
+	result := rc.authClaims.Get(key)
+	if !result.Exists() {
+		return nil
+	}
+	return result.Value()
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestFile writes a JSON file into the test's temporary directory and returns its path.
+func writeTestFile(t *testing.T, name string, value interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// encodeSegment encodes a JWT segment.
+func encodeSegment(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signTestToken builds a JWT with the given header and claims, signed by sign.
+func signTestToken(t *testing.T, header, claims map[string]interface{}, sign func(signingInput string) []byte) string {
+	t.Helper()
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingInput := encodeSegment(headerJSON) + "." + encodeSegment(claimsJSON)
+	return signingInput + "." + encodeSegment(sign(signingInput))
+}
+
+// rsaSigner signs tokens with RS256.
+func rsaSigner(t *testing.T, key *rsa.PrivateKey) func(string) []byte {
+	return func(signingInput string) []byte {
+		sum := sha256.Sum256([]byte(signingInput))
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signature
+	}
+}
+
+// ecdsaSigner signs tokens with ES256, as the fixed size r || s pair JWS uses.
+func ecdsaSigner(t *testing.T, key *ecdsa.PrivateKey) func(string) []byte {
+	return func(signingInput string) []byte {
+		sum := sha256.Sum256([]byte(signingInput))
+		r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		return signature
+	}
+}
+
+func TestVerifyJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwksFile := writeTestFile(t, "jwks.json", map[string]interface{}{
+		"keys": []map[string]interface{}{
+			{
+				"kty": "RSA",
+				"kid": "rsa-1",
+				"alg": "RS256",
+				"n":   encodeSegment(rsaKey.N.Bytes()),
+				"e":   encodeSegment(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+			{
+				"kty": "EC",
+				"kid": "ec-1",
+				"alg": "ES256",
+				"crv": "P-256",
+				"x":   encodeSegment(ecKey.X.FillBytes(make([]byte, 32))),
+				"y":   encodeSegment(ecKey.Y.FillBytes(make([]byte, 32))),
+			},
+		},
+	})
+	settings := &conf.JWTAuth{
+		JWKSFile: jwksFile,
+		Issuer:   "https://issuer.example.com",
+		Audience: "gateway",
+	}
+
+	now := time.Now()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub": "partner-a",
+			"iss": "https://issuer.example.com",
+			"aud": "gateway",
+			"exp": now.Add(time.Hour).Unix(),
+		}
+		for name, value := range changes {
+			if value == nil {
+				delete(c, name)
+				continue
+			}
+			c[name] = value
+		}
+		return c
+	}
+	rsaHeader := map[string]interface{}{"alg": "RS256", "kid": "rsa-1", "typ": "JWT"}
+	ecHeader := map[string]interface{}{"alg": "ES256", "kid": "ec-1", "typ": "JWT"}
+
+	validRSA := signTestToken(t, rsaHeader, claims(nil), rsaSigner(t, rsaKey))
+	parts := strings.Split(validRSA, ".")
+	forgedClaims, _ := json.Marshal(claims(map[string]interface{}{"sub": "partner-b"}))
+	tampered := parts[0] + "." + encodeSegment(forgedClaims) + "." + parts[2]
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{
+			name:  "valid RS256",
+			token: validRSA,
+		},
+		{
+			name:  "valid ES256",
+			token: signTestToken(t, ecHeader, claims(nil), ecdsaSigner(t, ecKey)),
+		},
+		{
+			name:    "tampered payload",
+			token:   tampered,
+			wantErr: "invalid token signature",
+		},
+		{
+			name: "alg none",
+			token: signTestToken(t, map[string]interface{}{"alg": "none", "kid": "rsa-1"}, claims(nil), func(string) []byte {
+				return nil
+			}),
+			wantErr: "unsupported token algorithm",
+		},
+		{
+			name: "alg HS256 keyed with the public key",
+			token: signTestToken(t, map[string]interface{}{"alg": "HS256", "kid": "rsa-1"}, claims(nil), func(signingInput string) []byte {
+				mac := hmac.New(sha256.New, rsaKey.N.Bytes())
+				mac.Write([]byte(signingInput))
+				return mac.Sum(nil)
+			}),
+			wantErr: "unsupported token algorithm",
+		},
+		{
+			name:    "RS256 header on an ES256 signature",
+			token:   signTestToken(t, map[string]interface{}{"alg": "RS256", "kid": "ec-1"}, claims(nil), ecdsaSigner(t, ecKey)),
+			wantErr: "invalid token signature",
+		},
+		{
+			name:    "expired",
+			token:   signTestToken(t, rsaHeader, claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()}), rsaSigner(t, rsaKey)),
+			wantErr: "token expired",
+		},
+		{
+			name:    "no expiry",
+			token:   signTestToken(t, rsaHeader, claims(map[string]interface{}{"exp": nil}), rsaSigner(t, rsaKey)),
+			wantErr: "token has no expiry",
+		},
+		{
+			name:    "wrong issuer",
+			token:   signTestToken(t, rsaHeader, claims(map[string]interface{}{"iss": "https://other.example.com"}), rsaSigner(t, rsaKey)),
+			wantErr: "token issuer https://other.example.com not accepted",
+		},
+		{
+			name:    "wrong audience",
+			token:   signTestToken(t, rsaHeader, claims(map[string]interface{}{"aud": []string{"billing"}}), rsaSigner(t, rsaKey)),
+			wantErr: "token audience not accepted",
+		},
+		{
+			name:    "malformed",
+			token:   "not-a-token",
+			wantErr: "malformed token",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := verifyJWT(tt.token, settings)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verifyJWT() error = %v, want none", err)
+				}
+				if sub := got.Get("sub").String(); sub != "partner-a" {
+					t.Errorf("sub = %q, want %q", sub, "partner-a")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("verifyJWT() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyAPIKey(t *testing.T) {
+	hash := func(key string) string {
+		sum := sha256.Sum256([]byte(key))
+		return hex.EncodeToString(sum[:])
+	}
+	keyFile := writeTestFile(t, "keys.json", map[string]interface{}{
+		"keys": []map[string]interface{}{
+			{
+				"hash":     hash("active-key"),
+				"consumer": "partner-a",
+				"scopes":   []string{"sim-swap:check", "sim-swap:read"},
+				"claims":   map[string]interface{}{"partner_id": "P-1"},
+			},
+			{
+				"hash":     hash("disabled-key"),
+				"consumer": "partner-b",
+				"disabled": true,
+			},
+		},
+	})
+
+	tests := []struct {
+		name      string
+		key       string
+		wantSub   string
+		wantScope string
+		wantErr   string
+	}{
+		{
+			name:      "active key",
+			key:       "active-key",
+			wantSub:   "partner-a",
+			wantScope: "sim-swap:check sim-swap:read",
+		},
+		{
+			name:    "disabled key",
+			key:     "disabled-key",
+			wantErr: "API key of partner-b is disabled",
+		},
+		{
+			name:    "unknown key",
+			key:     "other-key",
+			wantErr: "unknown API key",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := verifyAPIKey(tt.key, keyFile)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("verifyAPIKey() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifyAPIKey() error = %v, want none", err)
+			}
+			if sub := got.Get("sub").String(); sub != tt.wantSub {
+				t.Errorf("sub = %q, want %q", sub, tt.wantSub)
+			}
+			if scope := got.Get("scope").String(); scope != tt.wantScope {
+				t.Errorf("scope = %q, want %q", scope, tt.wantScope)
+			}
+			if partner := got.Get("partner_id").String(); partner != "P-1" {
+				t.Errorf("partner_id = %q, want %q", partner, "P-1")
+			}
+		})
+	}
+}
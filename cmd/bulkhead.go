@@ -0,0 +1,111 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"context"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+)
+
+// transportErrorBulkheadFull is the failure class of a call refused because the target
+// has too many calls in flight.
+const transportErrorBulkheadFull = "bulkhead_full"
+
+// errBulkheadFull is returned instead of calling a target that has no free slot.
+var errBulkheadFull = errors.New("too many concurrent calls to target")
+
+// Bulkhead metrics, keyed by target URL.
+var (
+	bulkheadInFlightMetric   = expvar.NewMap("bulkhead_in_flight")
+	bulkheadQueuedMetric     = expvar.NewMap("bulkhead_queued")
+	bulkheadRejectionsMetric = expvar.NewMap("bulkhead_rejections")
+)
+
+// bulkhead limits the calls in flight to one target, with a bounded queue of waiting calls.
+type bulkhead struct {
+	mu       sync.Mutex
+	name     string
+	settings conf.Bulkhead
+	slots    chan struct{}
+	queued   int
+}
+
+// Bulkheads by target URL.
+var (
+	bulkheadsMu sync.Mutex
+	bulkheads   = make(map[string]*bulkhead)
+)
+
+// targetBulkhead returns the bulkhead of a target, or nil when it has none.
+func targetBulkhead(target conf.APITarget) *bulkhead {
+	if target.Bulkhead == nil || target.Bulkhead.MaxConcurrent <= 0 {
+		return nil
+	}
+
+	bulkheadsMu.Lock()
+	defer bulkheadsMu.Unlock()
+	if b, ok := bulkheads[target.URL]; ok {
+		return b
+	}
+	b := &bulkhead{
+		name:     target.URL,
+		settings: *target.Bulkhead,
+		slots:    make(chan struct{}, target.Bulkhead.MaxConcurrent),
+	}
+	bulkheads[target.URL] = b
+	return b
+}
+
+// acquire takes a slot, waiting in the queue for at most the queue timeout when all
+// slots are in use. The slot must be given back with release.
+func (b *bulkhead) acquire(ctx context.Context) error {
+	select {
+	case b.slots <- struct{}{}:
+		bulkheadInFlightMetric.Add(b.name, 1)
+		return nil
+	default:
+	}
+
+	b.mu.Lock()
+	if b.queued >= b.settings.MaxQueue {
+		b.mu.Unlock()
+		bulkheadRejectionsMetric.Add(b.name, 1)
+		return &transportError{class: transportErrorBulkheadFull, err: errBulkheadFull}
+	}
+	b.queued++
+	bulkheadQueuedMetric.Add(b.name, 1)
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		b.queued--
+		bulkheadQueuedMetric.Add(b.name, -1)
+		b.mu.Unlock()
+	}()
+
+	var timeout <-chan time.Time
+	if b.settings.QueueTimeout > 0 {
+		timer := time.NewTimer(b.settings.QueueTimeout.Duration())
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case b.slots <- struct{}{}:
+		bulkheadInFlightMetric.Add(b.name, 1)
+		return nil
+	case <-timeout:
+		bulkheadRejectionsMetric.Add(b.name, 1)
+		return &transportError{class: transportErrorBulkheadFull, err: errBulkheadFull}
+	case <-ctx.Done():
+		return &transportError{class: classifyTransportError(ctx.Err()), err: ctx.Err()}
+	}
+}
+
+// release gives back a slot taken with acquire.
+func (b *bulkhead) release() {
+	<-b.slots
+	bulkheadInFlightMetric.Add(b.name, -1)
+}
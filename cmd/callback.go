@@ -0,0 +1,413 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Callback outbox, retry and timeout settings.
+const (
+	defaultOutboxDir         = "outbox"
+	defaultCallbackAttempts  = 5
+	defaultCallbackBackoff   = time.Second
+	defaultCallbackMaxWait   = time.Minute
+	callbackRequestTimeout   = 10 * time.Second
+	failedDeliverySuffix     = ".failed"
+	outboxEntryFileExtension = ".json"
+)
+
+// Callback metrics, keyed by API mapping name.
+var (
+	callbacksDeliveredMetric = expvar.NewMap("callbacks_delivered")
+	callbacksFailedMetric    = expvar.NewMap("callbacks_failed")
+)
+
+// errCallbackAddress is returned for a callback URL the gateway must not call.
+var errCallbackAddress = errors.New("callback address is not public")
+
+// nonPublicNetworks are the address ranges callbacks may not reach unless their host is
+// allowed explicitly, on top of loopback, private, link-local and multicast addresses.
+var nonPublicNetworks = parseNetworks("0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4")
+
+// Callbacks never follow redirects, which could lead them to a host that was not checked.
+var (
+	// callbackClient delivers callbacks to allowed hosts.
+	callbackClient = &http.Client{
+		Timeout:       callbackRequestTimeout,
+		CheckRedirect: noRedirects,
+	}
+	// publicCallbackClient delivers callbacks of API mappings without allowed hosts. It checks
+	// the address it connects to, so a host name cannot resolve to an internal address later.
+	// It never uses a proxy, whose address is all the check would see.
+	publicCallbackClient = &http.Client{
+		Timeout:       callbackRequestTimeout,
+		CheckRedirect: noRedirects,
+		Transport: &http.Transport{
+			Proxy: nil,
+			DialContext: (&net.Dialer{
+				Timeout: callbackRequestTimeout,
+				Control: func(network, address string, _ syscall.RawConn) error {
+					host, _, err := net.SplitHostPort(address)
+					if err != nil {
+						return err
+					}
+					if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+						return errCallbackAddress
+					}
+					return nil
+				},
+			}).DialContext,
+			TLSHandshakeTimeout: callbackRequestTimeout,
+		},
+	}
+)
+
+// noRedirects stops a client at the first redirect.
+func noRedirects(*http.Request, []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// outboxEntry is a callback waiting for delivery, stored in the outbox directory until
+// it has been delivered.
+type outboxEntry struct {
+	ID       string            `json:"id"`
+	Endpoint string            `json:"endpoint"`
+	URL      string            `json:"url"`
+	Headers  map[string]string `json:"headers"`
+	Body     json.RawMessage   `json:"body"`
+	Attempts int               `json:"attempts"`
+}
+
+// responseRecorder keeps a mapped response instead of sending it.
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(b)
+}
+
+// dispatchAsyncRequest answers an asynchronous request with the accepted response, then
+// calls the target in the background and delivers the mapped response to the callback URL.
+// Requests without a callback URL are handled synchronously, and false is returned.
+func dispatchAsyncRequest(w http.ResponseWriter, r *http.Request, endpoint conf.APIEndpoint) bool {
+	async := endpoint.Async
+	if async == nil {
+		return false
+	}
+	callbackURL, _ := mapData(async.CallbackURL, r, r.Header).(string)
+	if callbackURL == "" {
+		return false
+	}
+
+	// The gateway only calls back where the configuration lets it, never an internal host
+	// named by the caller.
+	if err := checkCallbackURL(r.Context(), async, callbackURL); err != nil {
+		fmt.Printf("CALLBACK URL %s rejected: %v\n", callbackURL, err)
+		if res := async.OnInvalidCallback; res != nil {
+			writeMappedResponse(w, r, *res)
+			return true
+		}
+		writeJSONResponse(w, http.StatusBadRequest, map[string]interface{}{
+			"status":  http.StatusBadRequest,
+			"code":    "INVALID_ARGUMENT",
+			"message": "Invalid callback URL",
+		})
+		return true
+	}
+
+	headers := make(map[string]string)
+	for name, value := range async.Headers {
+		if mapped := mapData(value, r, r.Header); mapped != nil {
+			headers[name] = fmt.Sprint(mapped)
+		}
+	}
+	writeMappedResponse(w, r, async.Accepted)
+
+	// The target call outlives the inbound request, so its context keeps the request data
+	// but is not cancelled with it.
+	background := r.Clone(context.WithoutCancel(r.Context()))
+	go func() {
+		rec := &responseRecorder{header: make(http.Header)}
+		handleMappedRequest(rec, background, endpoint, nil, "")
+		getRequestContext(background).removeMultipartFiles()
+
+		// Errors answered as plain text are delivered as JSON too.
+		body := rec.body.Bytes()
+		if !json.Valid(body) {
+			body, _ = json.Marshal(map[string]interface{}{
+				"status":  rec.status,
+				"message": strings.TrimSpace(rec.body.String()),
+			})
+		}
+		entry := &outboxEntry{
+			ID:       uuid.New().String(),
+			Endpoint: endpoint.Name,
+			URL:      callbackURL,
+			Headers:  headers,
+			Body:     body,
+		}
+		if err := entry.save(); err != nil {
+			fmt.Printf("CALLBACK %s not stored in outbox: %v\n", entry.ID, err)
+		}
+		deliverCallback(entry)
+	}()
+	return true
+}
+
+// checkCallbackURL reports why the gateway may not call a callback URL: it must use https,
+// and its host must be allowed by the API mapping or, when none are listed, resolve to public
+// addresses only.
+func checkCallbackURL(ctx context.Context, async *conf.AsyncMode, callbackURL string) error {
+	parsed, err := url.Parse(callbackURL)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "https" {
+		return errors.New("callback URL must use https")
+	}
+	host := strings.ToLower(parsed.Hostname())
+	if host == "" {
+		return errors.New("callback URL has no host")
+	}
+
+	if len(async.AllowedHosts) > 0 {
+		for _, allowed := range async.AllowedHosts {
+			if matchesHostPattern(strings.ToLower(allowed), host) {
+				return nil
+			}
+		}
+		return fmt.Errorf("callback host %s is not allowed", host)
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !isPublicIP(addr.IP) {
+			return errCallbackAddress
+		}
+	}
+	return nil
+}
+
+// matchesHostPattern reports whether a host is the pattern or, for a "*.example.com"
+// pattern, one of its subdomains.
+func matchesHostPattern(pattern, host string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasPrefix(suffix, ".") && strings.HasSuffix(host, suffix)
+	}
+	return pattern == host
+}
+
+// isPublicIP reports whether an address is publicly routable: not loopback, private,
+// link-local, multicast, unspecified or otherwise reserved.
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseNetworks parses CIDR address ranges.
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+// outboxDir returns the directory that keeps undelivered callbacks.
+func outboxDir() string {
+	if config.OutboxDir != "" {
+		return config.OutboxDir
+	}
+	return defaultOutboxDir
+}
+
+// path returns the file of an outbox entry.
+func (e *outboxEntry) path() string {
+	return filepath.Join(outboxDir(), e.ID+outboxEntryFileExtension)
+}
+
+// save writes an outbox entry to disk.
+func (e *outboxEntry) save() error {
+	if err := os.MkdirAll(outboxDir(), 0o755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(e.path(), data)
+}
+
+// deliverCallback posts a callback until the receiver accepts it or the attempts run out.
+// A delivered callback leaves the outbox; one that keeps failing is kept as a .failed file.
+func deliverCallback(entry *outboxEntry) {
+	var endpoint conf.APIEndpoint
+	for _, e := range config.APIMappings {
+		if e.Name == entry.Endpoint {
+			endpoint = e
+			break
+		}
+	}
+	if endpoint.Async == nil {
+		fmt.Printf("CALLBACK %s: API mapping %s is not asynchronous\n", entry.ID, entry.Endpoint)
+		return
+	}
+	policy := callbackRetryPolicy(endpoint.Async.Retry)
+
+	// Entries resumed from the outbox are checked against the current configuration too.
+	if err := checkCallbackURL(context.Background(), endpoint.Async, entry.URL); err != nil {
+		fmt.Printf("CALLBACK %s to %s not sent: %v\n", entry.ID, entry.URL, err)
+		callbacksFailedMetric.Add(entry.Endpoint, 1)
+		if err := os.Rename(entry.path(), entry.path()+failedDeliverySuffix); err != nil {
+			fmt.Printf("CALLBACK %s not kept: %v\n", entry.ID, err)
+		}
+		return
+	}
+
+	for {
+		entry.Attempts++
+		err := postCallback(entry, endpoint.Async)
+		if err == nil {
+			fmt.Printf("CALLBACK %s delivered to %s (attempt %d)\n", entry.ID, entry.URL, entry.Attempts)
+			callbacksDeliveredMetric.Add(entry.Endpoint, 1)
+			_ = os.Remove(entry.path())
+			return
+		}
+		fmt.Printf("CALLBACK %s to %s failed (attempt %d): %v\n", entry.ID, entry.URL, entry.Attempts, err)
+
+		if entry.Attempts >= policy.MaxAttempts {
+			callbacksFailedMetric.Add(entry.Endpoint, 1)
+			if err := os.Rename(entry.path(), entry.path()+failedDeliverySuffix); err != nil {
+				fmt.Printf("CALLBACK %s not kept: %v\n", entry.ID, err)
+			}
+			return
+		}
+		if err := entry.save(); err != nil {
+			fmt.Printf("CALLBACK %s not stored in outbox: %v\n", entry.ID, err)
+		}
+		time.Sleep(retryBackoff(&policy, entry.Attempts))
+	}
+}
+
+// callbackRetryPolicy fills in the defaults of a callback retry policy.
+func callbackRetryPolicy(retry *conf.RetryPolicy) conf.RetryPolicy {
+	policy := conf.RetryPolicy{
+		MaxAttempts:    defaultCallbackAttempts,
+		InitialBackoff: conf.Duration(defaultCallbackBackoff),
+		MaxBackoff:     conf.Duration(defaultCallbackMaxWait),
+	}
+	if retry == nil {
+		return policy
+	}
+	if retry.MaxAttempts > 0 {
+		policy.MaxAttempts = retry.MaxAttempts
+	}
+	if retry.InitialBackoff > 0 {
+		policy.InitialBackoff = retry.InitialBackoff
+	}
+	if retry.MaxBackoff > 0 {
+		policy.MaxBackoff = retry.MaxBackoff
+	}
+	policy.Multiplier = retry.Multiplier
+	return policy
+}
+
+// postCallback sends a callback once. Any 2xx status means it was delivered.
+func postCallback(entry *outboxEntry, async *conf.AsyncMode) error {
+	req, err := http.NewRequest(http.MethodPost, entry.URL, bytes.NewReader(entry.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range entry.Headers {
+		req.Header.Set(name, value)
+	}
+	if async.Signing != nil {
+		if err := signTargetRequest(req, entry.Body, async.Signing); err != nil {
+			return err
+		}
+	}
+
+	client := publicCallbackClient
+	if len(async.AllowedHosts) > 0 {
+		client = callbackClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("callback returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// resumeOutbox delivers the callbacks left in the outbox by a previous run.
+func resumeOutbox() {
+	files, err := filepath.Glob(filepath.Join(outboxDir(), "*"+outboxEntryFileExtension))
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file, failedDeliverySuffix) {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Printf("Failed to read outbox entry %s: %v\n", file, err)
+			continue
+		}
+		entry := &outboxEntry{}
+		if err := json.Unmarshal(data, entry); err != nil {
+			fmt.Printf("Failed to read outbox entry %s: %v\n", file, err)
+			continue
+		}
+		fmt.Printf("CALLBACK %s resumed from outbox\n", entry.ID)
+		go deliverCallback(entry)
+	}
+}
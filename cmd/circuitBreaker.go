@@ -0,0 +1,182 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"errors"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states.
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// Circuit breaker defaults.
+const (
+	defaultFailureThreshold = 5
+	defaultOpenDuration     = 30 * time.Second
+	defaultHalfOpenProbes   = 1
+)
+
+// transportErrorCircuitOpen is the failure class of a call refused by an open circuit.
+const transportErrorCircuitOpen = "circuit_open"
+
+// errCircuitOpen is returned instead of calling a target whose circuit is open.
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// Circuit breaker metrics, keyed by target URL.
+var (
+	circuitStateMetric      = expvar.NewMap("circuit_breaker_state")
+	circuitRejectionsMetric = expvar.NewMap("circuit_breaker_rejections")
+)
+
+// circuitBreaker tracks the failures of one target.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	name      string
+	settings  conf.CircuitBreaker
+	state     string
+	failures  int
+	openedAt  time.Time
+	probes    int
+	successes int
+}
+
+// Circuit breakers by target URL.
+var (
+	circuitBreakersMu sync.Mutex
+	circuitBreakers   = make(map[string]*circuitBreaker)
+)
+
+// targetCircuitBreaker returns the circuit breaker of a target, or nil when it has none.
+func targetCircuitBreaker(target conf.APITarget) *circuitBreaker {
+	if target.CircuitBreaker == nil {
+		return nil
+	}
+
+	circuitBreakersMu.Lock()
+	defer circuitBreakersMu.Unlock()
+	if breaker, ok := circuitBreakers[target.URL]; ok {
+		return breaker
+	}
+
+	settings := *target.CircuitBreaker
+	if settings.FailureThreshold <= 0 {
+		settings.FailureThreshold = defaultFailureThreshold
+	}
+	if settings.OpenDuration <= 0 {
+		settings.OpenDuration = conf.Duration(defaultOpenDuration)
+	}
+	if settings.HalfOpenProbes <= 0 {
+		settings.HalfOpenProbes = defaultHalfOpenProbes
+	}
+
+	breaker := &circuitBreaker{name: target.URL, settings: settings}
+	breaker.setState(circuitClosed)
+	circuitBreakers[target.URL] = breaker
+	return breaker
+}
+
+// allow reports whether the target may be called. Once the open duration has passed,
+// a limited number of probe calls are let through to test the target.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == circuitOpen && time.Since(b.openedAt) >= b.settings.OpenDuration.Duration() {
+		b.setState(circuitHalfOpen)
+		b.probes = 0
+		b.successes = 0
+	}
+
+	switch b.state {
+	case circuitOpen:
+		circuitRejectionsMetric.Add(b.name, 1)
+		return false
+	case circuitHalfOpen:
+		if b.probes >= b.settings.HalfOpenProbes {
+			circuitRejectionsMetric.Add(b.name, 1)
+			return false
+		}
+		b.probes++
+	}
+	return true
+}
+
+// record updates the breaker with the outcome of a target call.
+func (b *circuitBreaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitHalfOpen:
+		if !success {
+			b.open()
+			return
+		}
+		b.successes++
+		if b.successes >= b.settings.HalfOpenProbes {
+			b.failures = 0
+			b.setState(circuitClosed)
+		}
+	case circuitClosed:
+		if success {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.settings.FailureThreshold {
+			b.open()
+		}
+	}
+}
+
+// release settles a call whose outcome is not recorded, letting another probe through
+// when the circuit is half-open.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == circuitHalfOpen && b.probes > b.successes {
+		b.probes--
+	}
+}
+
+// open stops calls to the target for the open duration.
+func (b *circuitBreaker) open() {
+	b.openedAt = time.Now()
+	b.failures = 0
+	b.setState(circuitOpen)
+}
+
+// setState changes the state and publishes it.
+func (b *circuitBreaker) setState(state string) {
+	if b.state != "" && b.state != state {
+		fmt.Printf("CIRCUIT BREAKER %s: %s -> %s\n", b.name, b.state, state)
+	}
+	b.state = state
+	value := new(expvar.String)
+	value.Set(state)
+	circuitStateMetric.Set(b.name, value)
+}
+
+// isTargetFailure reports whether a target call counts as a failure for the circuit breaker.
+func isTargetFailure(settings conf.CircuitBreaker, code int, err error) bool {
+	if err != nil {
+		return true
+	}
+	if len(settings.FailureStatus) == 0 {
+		return code >= 500
+	}
+	for _, status := range settings.FailureStatus {
+		if status == code {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultDeadlineHeader is the inbound header holding the client deadline when deadlineHeader is not configured.
+const defaultDeadlineHeader = "X-Request-Timeout"
+
+// Connection pool settings used when neither the target nor targetDefaults set them.
+const (
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 16
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultKeepAlive           = 30 * time.Second
+)
+
+// targetClientKey identifies the pooled client of a target.
+type targetClientKey struct {
+	url       string
+	timeouts  conf.Timeouts
+	transport conf.TransportSettings
+	tls       *conf.TLSSettings
+}
+
+// Pooled clients by target, so connections are reused across requests.
+var (
+	targetClientsMu sync.Mutex
+	targetClients   = make(map[targetClientKey]*http.Client)
+)
+
+// effectiveTimeouts returns the timeouts of a target, falling back to the global defaults.
+func effectiveTimeouts(target conf.APITarget) conf.Timeouts {
+	timeouts := config.TargetDefaults.Timeouts
+	if target.Timeouts == nil {
+		return timeouts
+	}
+	if target.Timeouts.Connect > 0 {
+		timeouts.Connect = target.Timeouts.Connect
+	}
+	if target.Timeouts.TLSHandshake > 0 {
+		timeouts.TLSHandshake = target.Timeouts.TLSHandshake
+	}
+	if target.Timeouts.ResponseHeader > 0 {
+		timeouts.ResponseHeader = target.Timeouts.ResponseHeader
+	}
+	if target.Timeouts.Total > 0 {
+		timeouts.Total = target.Timeouts.Total
+	}
+	return timeouts
+}
+
+// effectiveTransport returns the connection pool settings of a target, falling back to
+// the global defaults and then to the gateway defaults.
+func effectiveTransport(target conf.APITarget) conf.TransportSettings {
+	settings := config.TargetDefaults.Transport
+	if t := target.Transport; t != nil {
+		if t.MaxIdleConns > 0 {
+			settings.MaxIdleConns = t.MaxIdleConns
+		}
+		if t.MaxIdleConnsPerHost > 0 {
+			settings.MaxIdleConnsPerHost = t.MaxIdleConnsPerHost
+		}
+		if t.MaxConnsPerHost > 0 {
+			settings.MaxConnsPerHost = t.MaxConnsPerHost
+		}
+		if t.IdleConnTimeout > 0 {
+			settings.IdleConnTimeout = t.IdleConnTimeout
+		}
+		if t.KeepAlive > 0 {
+			settings.KeepAlive = t.KeepAlive
+		}
+		if t.MaxResponseHeaderBytes > 0 {
+			settings.MaxResponseHeaderBytes = t.MaxResponseHeaderBytes
+		}
+		settings.DisableKeepAlives = settings.DisableKeepAlives || t.DisableKeepAlives
+		settings.DisableHTTP2 = settings.DisableHTTP2 || t.DisableHTTP2
+	}
+
+	if settings.MaxIdleConns <= 0 {
+		settings.MaxIdleConns = defaultMaxIdleConns
+	}
+	if settings.MaxIdleConnsPerHost <= 0 {
+		settings.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	if settings.IdleConnTimeout <= 0 {
+		settings.IdleConnTimeout = conf.Duration(defaultIdleConnTimeout)
+	}
+	if settings.KeepAlive <= 0 {
+		settings.KeepAlive = conf.Duration(defaultKeepAlive)
+	}
+	return settings
+}
+
+// targetClient returns the pooled HTTP client used to call a target.
+func targetClient(target conf.APITarget) (*http.Client, error) {
+	key := targetClientKey{
+		url:       target.URL,
+		timeouts:  effectiveTimeouts(target),
+		transport: effectiveTransport(target),
+		tls:       target.TLS,
+	}
+
+	targetClientsMu.Lock()
+	defer targetClientsMu.Unlock()
+	if client, ok := targetClients[key]; ok {
+		return client, nil
+	}
+
+	transport := newTargetTransport(key.timeouts, key.transport)
+	if target.TLS != nil {
+		tlsConfig, err := newTargetTLSConfig(target.TLS)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	client := &http.Client{
+		Timeout:   key.timeouts.Total.Duration(),
+		Transport: transport,
+	}
+	targetClients[key] = client
+	return client, nil
+}
+
+// newTargetTransport builds the connection pool of a target.
+func newTargetTransport(timeouts conf.Timeouts, settings conf.TransportSettings) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   timeouts.Connect.Duration(),
+		KeepAlive: settings.KeepAlive.Duration(),
+	}
+	transport := &http.Transport{
+		Proxy:                  http.ProxyFromEnvironment,
+		DialContext:            dialer.DialContext,
+		TLSHandshakeTimeout:    timeouts.TLSHandshake.Duration(),
+		ResponseHeaderTimeout:  timeouts.ResponseHeader.Duration(),
+		ForceAttemptHTTP2:      !settings.DisableHTTP2,
+		MaxIdleConns:           settings.MaxIdleConns,
+		MaxIdleConnsPerHost:    settings.MaxIdleConnsPerHost,
+		MaxConnsPerHost:        settings.MaxConnsPerHost,
+		IdleConnTimeout:        settings.IdleConnTimeout.Duration(),
+		DisableKeepAlives:      settings.DisableKeepAlives,
+		MaxResponseHeaderBytes: settings.MaxResponseHeaderBytes,
+	}
+	if settings.DisableHTTP2 {
+		// An empty, non-nil TLSNextProto keeps the transport on HTTP/1.1.
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return transport
+}
+
+// withClientDeadline bounds the request context by the deadline the client sent in the
+// deadline header, given as a duration ("1500ms", "2s") or a number of milliseconds.
+func withClientDeadline(r *http.Request) (*http.Request, context.CancelFunc) {
+	headerName := config.DeadlineHeader
+	if headerName == "" {
+		headerName = defaultDeadlineHeader
+	}
+
+	value := r.Header.Get(headerName)
+	if value == "" {
+		return r, func() {}
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		millis, convErr := strconv.Atoi(value)
+		if convErr != nil {
+			fmt.Printf("Invalid %s header: %s\n", headerName, value)
+			return r, func() {}
+		}
+		timeout = time.Duration(millis) * time.Millisecond
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return r.WithContext(ctx), cancel
+}
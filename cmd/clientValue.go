@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/x509"
+	"net"
+	"net/http"
+)
+
+// getClientValue returns a property of the requesting client: its IP address, or the
+// subject or common name of its verified TLS client certificate.
+func getClientValue(r *http.Request, key string) interface{} {
+	switch key {
+	case "ip":
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr
+		}
+		return host
+	case "cert_subject", "cert_cn":
+		cert := clientCertificate(r)
+		if cert == nil {
+			return nil
+		}
+		if key == "cert_cn" {
+			return cert.Subject.CommonName
+		}
+		return cert.Subject.String()
+	}
+	return nil
+}
+
+// clientCertificate returns the verified client certificate of a request, if it sent one.
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return r.TLS.PeerCertificates[0]
+}
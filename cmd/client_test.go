@@ -0,0 +1,57 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newBenchmarkTarget starts a target answering every call with a small JSON body.
+func newBenchmarkTarget(b *testing.B) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"ok":true}`)
+	}))
+	b.Cleanup(server.Close)
+	return server
+}
+
+// callBenchmarkTarget makes one call and drains the response so its connection can be reused.
+func callBenchmarkTarget(b *testing.B, client *http.Client, url string) {
+	resp, err := client.Get(url)
+	if err != nil {
+		b.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// BenchmarkTargetClientPooled calls a target with its pooled client, as the gateway does.
+func BenchmarkTargetClientPooled(b *testing.B) {
+	server := newBenchmarkTarget(b)
+	target := conf.APITarget{URL: server.URL, Method: http.MethodGet}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client, err := targetClient(target)
+		if err != nil {
+			b.Fatal(err)
+		}
+		callBenchmarkTarget(b, client, server.URL)
+	}
+}
+
+// BenchmarkTargetClientFresh calls a target with a new client and transport for every call,
+// so each call opens its own connection, as without a pooled client per target.
+func BenchmarkTargetClientFresh(b *testing.B) {
+	server := newBenchmarkTarget(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		transport := &http.Transport{}
+		callBenchmarkTarget(b, &http.Client{Transport: transport}, server.URL)
+		transport.CloseIdleConnections()
+	}
+}
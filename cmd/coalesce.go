@@ -0,0 +1,117 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// coalescedRequestsMetric counts requests that shared another request's target call,
+// keyed by API mapping name.
+var coalescedRequestsMetric = expvar.NewMap("coalesced_requests")
+
+// flightCall is a target call in progress that other requests may wait for.
+type flightCall struct {
+	done   chan struct{}
+	result targetResult
+	// abandoned is set when the caller gave up, so its outcome says nothing about the target.
+	abandoned bool
+}
+
+// flightGroup tracks the target calls in progress of one API mapping by key.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// Flight groups by API mapping name.
+var (
+	flightGroupsMu sync.Mutex
+	flightGroups   = make(map[string]*flightGroup)
+)
+
+// endpointFlightGroup returns the flight group of an API mapping.
+func endpointFlightGroup(name string) *flightGroup {
+	flightGroupsMu.Lock()
+	defer flightGroupsMu.Unlock()
+	group, ok := flightGroups[name]
+	if !ok {
+		group = &flightGroup{calls: make(map[string]*flightCall)}
+		flightGroups[name] = group
+	}
+	return group
+}
+
+// coalesceKey identifies requests that may share a target call: the configured src:
+// expressions, or else the mapped target request. Either way the mapped target headers are
+// part of the key, so callers whose headers carry a different identity never share a call.
+func coalesceKey(endpoint conf.APIEndpoint, reqBody []byte, headers http.Header, r *http.Request) string {
+	hash := sha256.New()
+	if len(endpoint.Coalesce.Key) > 0 {
+		for _, expression := range endpoint.Coalesce.Key {
+			fmt.Fprintf(hash, "%v\n", mapData(expression, r, r.Header))
+		}
+	} else {
+		fmt.Fprintf(hash, "%s %s\n", endpoint.Target.Method, endpoint.Target.URL)
+		hash.Write(reqBody)
+		hash.Write([]byte("\n"))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(hash, "%s: %s\n", name, strings.Join(headers[name], ","))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// coalescedTargetRequest performs the target call of a request. When coalescing is on and an
+// identical call is already in progress, it waits for that call and shares its response
+// instead of calling the target again. Each request still maps the response itself.
+func coalescedTargetRequest(endpoint conf.APIEndpoint, reqBody []byte, headers http.Header, r *http.Request) (int, error) {
+	if endpoint.Coalesce == nil || !endpoint.Coalesce.Enabled {
+		return performTargetRequest(endpoint.Target, reqBody, headers, r)
+	}
+
+	key := coalesceKey(endpoint, reqBody, headers, r)
+	group := endpointFlightGroup(endpoint.Name)
+
+	group.mu.Lock()
+	if call, ok := group.calls[key]; ok {
+		group.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-r.Context().Done():
+			err := r.Context().Err()
+			return 0, &transportError{class: classifyTransportError(err), err: err}
+		}
+		// The shared call ended because its own caller gave up, make this call separately.
+		if call.abandoned {
+			return performTargetRequest(endpoint.Target, reqBody, headers, r)
+		}
+		fmt.Println("COALESCED TARGET CALL:", key)
+		coalescedRequestsMetric.Add(endpoint.Name, 1)
+		return useTargetResult(r, &call.result)
+	}
+	call := &flightCall{done: make(chan struct{})}
+	group.calls[key] = call
+	group.mu.Unlock()
+
+	call.result = callTarget(endpoint.Target, reqBody, headers, r)
+	call.abandoned = r.Context().Err() != nil
+
+	group.mu.Lock()
+	delete(group.calls, key)
+	group.mu.Unlock()
+	close(call.done)
+	return useTargetResult(r, &call.result)
+}
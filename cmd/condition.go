@@ -0,0 +1,162 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Condition operators.
+const (
+	operatorEquals      = "equals"
+	operatorNotEquals   = "notEquals"
+	operatorIn          = "in"
+	operatorNotIn       = "notIn"
+	operatorExists      = "exists"
+	operatorNotExists   = "notExists"
+	operatorMatches     = "matches"
+	operatorGreaterThan = "greaterThan"
+	operatorLessThan    = "lessThan"
+	operatorContains    = "contains"
+)
+
+// evaluateCondition reports whether a condition holds for the current request. A condition
+// that cannot be evaluated, such as one with an unsupported operator, does not hold.
+func evaluateCondition(condition conf.Condition, r *http.Request) bool {
+	holds, err := conditionHolds(condition, r)
+	if err != nil {
+		fmt.Println("Invalid condition:", err)
+		return false
+	}
+	return holds
+}
+
+// conditionHolds evaluates a condition for the current request. Values are compared as
+// text, except by greaterThan and lessThan, which compare numbers. contains looks for the
+// value in an array, or among the words of a text such as a scope claim.
+func conditionHolds(condition conf.Condition, r *http.Request) (bool, error) {
+	for _, c := range condition.All {
+		if holds, err := conditionHolds(c, r); err != nil || !holds {
+			return false, err
+		}
+	}
+	if len(condition.Any) > 0 {
+		matched := false
+		for _, c := range condition.Any {
+			holds, err := conditionHolds(c, r)
+			if err != nil {
+				return false, err
+			}
+			if holds {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+	if condition.Source == "" {
+		return true, nil
+	}
+
+	value := mapData(condition.Source, r, r.Header)
+	exists := value != nil && value != ""
+	text := fmt.Sprint(value)
+
+	switch condition.Operator {
+	case operatorExists:
+		return exists, nil
+	case operatorNotExists:
+		return !exists, nil
+	case operatorEquals, "":
+		return exists && text == fmt.Sprint(condition.Value), nil
+	case operatorNotEquals:
+		return !exists || text != fmt.Sprint(condition.Value), nil
+	case operatorIn, operatorNotIn:
+		values, ok := condition.Value.([]interface{})
+		if !ok {
+			return false, fmt.Errorf("%s needs a list of values", condition.Operator)
+		}
+		found := false
+		for _, v := range values {
+			if exists && text == fmt.Sprint(v) {
+				found = true
+				break
+			}
+		}
+		return found == (condition.Operator == operatorIn), nil
+	case operatorMatches:
+		pattern, err := regexp.Compile(fmt.Sprint(condition.Value))
+		if err != nil {
+			return false, err
+		}
+		return exists && pattern.MatchString(text), nil
+	case operatorContains:
+		want := fmt.Sprint(condition.Value)
+		if values, ok := value.([]interface{}); ok {
+			for _, v := range values {
+				if fmt.Sprint(v) == want {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+		for _, word := range strings.Fields(text) {
+			if word == want {
+				return true, nil
+			}
+		}
+		return false, nil
+	case operatorGreaterThan, operatorLessThan:
+		right, err := strconv.ParseFloat(fmt.Sprint(condition.Value), 64)
+		if err != nil {
+			return false, fmt.Errorf("%s needs a number: %v", condition.Operator, condition.Value)
+		}
+		left, err := strconv.ParseFloat(text, 64)
+		if err != nil || !exists {
+			return false, nil
+		}
+		if condition.Operator == operatorGreaterThan {
+			return left > right, nil
+		}
+		return left < right, nil
+	default:
+		return false, fmt.Errorf("unsupported condition operator: %s", condition.Operator)
+	}
+}
+
+// validateCondition checks the operators and values of a condition when the configuration
+// is loaded.
+func validateCondition(condition conf.Condition) error {
+	for _, c := range append(append([]conf.Condition{}, condition.All...), condition.Any...) {
+		if err := validateCondition(c); err != nil {
+			return err
+		}
+	}
+	if condition.Source == "" {
+		return nil
+	}
+	switch condition.Operator {
+	case operatorEquals, "", operatorNotEquals, operatorExists, operatorNotExists, operatorContains:
+		return nil
+	case operatorIn, operatorNotIn:
+		if _, ok := condition.Value.([]interface{}); !ok {
+			return fmt.Errorf("%s on %s needs a list of values", condition.Operator, condition.Source)
+		}
+	case operatorMatches:
+		if _, err := regexp.Compile(fmt.Sprint(condition.Value)); err != nil {
+			return fmt.Errorf("matches on %s: %w", condition.Source, err)
+		}
+	case operatorGreaterThan, operatorLessThan:
+		if _, err := strconv.ParseFloat(fmt.Sprint(condition.Value), 64); err != nil {
+			return fmt.Errorf("%s on %s needs a number", condition.Operator, condition.Source)
+		}
+	default:
+		return fmt.Errorf("unsupported condition operator %q on %s", condition.Operator, condition.Source)
+	}
+	return nil
+}
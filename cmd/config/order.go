@@ -0,0 +1,48 @@
+package config
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/tidwall/gjson"
+)
+
+// UnmarshalJSON decodes the request mapping and records the key order of requestBody,
+// which Go maps lose but XML targets depend on.
+func (m *RequestMapping) UnmarshalJSON(data []byte) error {
+	type plain RequestMapping
+	if err := json.Unmarshal(data, (*plain)(m)); err != nil {
+		return err
+	}
+
+	m.RequestBodyOrder = make(map[string][]string)
+	collectKeyOrder(gjson.GetBytes(data, "requestBody"), "", m.RequestBodyOrder)
+	return nil
+}
+
+// collectKeyOrder stores the keys of every object in document order, indexed by the
+// dot-separated path of the object ("" for the root, "parameter", "items.0", ...).
+func collectKeyOrder(value gjson.Result, path string, order map[string][]string) {
+	switch {
+	case value.IsObject():
+		var keys []string
+		value.ForEach(func(key, child gjson.Result) bool {
+			keys = append(keys, key.String())
+			collectKeyOrder(child, JoinPath(path, key.String()), order)
+			return true
+		})
+		order[path] = keys
+	case value.IsArray():
+		for i, item := range value.Array() {
+			collectKeyOrder(item, JoinPath(path, strconv.Itoa(i)), order)
+		}
+	}
+}
+
+// JoinPath appends a key to a dot-separated path.
+func JoinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -2,8 +2,21 @@ package config
 
 // Configuration represents the entire JSON configuration.
 type Configuration struct {
-	APIMappings   []APIEndpoint  `json:"apiMappings"`
-	PluginConfigs []PluginConfig `json:"pluginConfigs"`
+	APIMappings    []APIEndpoint  `json:"apiMappings"`
+	PluginConfigs  []PluginConfig `json:"pluginConfigs"`
+	TargetDefaults TargetDefaults `json:"targetDefaults"`
+	DeadlineHeader string         `json:"deadlineHeader,omitempty"`
+	QuotaFile      string         `json:"quotaFile,omitempty"`
+	OutboxDir      string         `json:"outboxDir,omitempty"`
+	MockMode       bool           `json:"mockMode,omitempty"`
+	Server         ServerSettings `json:"server"`
+	CORS           *CORSPolicy    `json:"cors,omitempty"`
+}
+
+// TargetDefaults defines settings used by every target that does not set its own.
+type TargetDefaults struct {
+	Timeouts  Timeouts          `json:"timeouts"`
+	Transport TransportSettings `json:"transport"`
 }
 
 // APIEndpoint represents an API mapping configuration.
@@ -14,25 +27,365 @@ type APIEndpoint struct {
 	Target              APITarget       `json:"target"`
 	RequestMapping      RequestMapping  `json:"requestMapping"`
 	ResponseMapping     ResponseMapping `json:"responseMapping"`
+	Cache               *ResponseCache  `json:"cache,omitempty"`
+	Coalesce            *Coalesce       `json:"coalesce,omitempty"`
+	RateLimit           *RateLimit      `json:"rateLimit,omitempty"`
+	Steps               []Step          `json:"steps,omitempty"`
+	FanOut              *FanOut         `json:"fanOut,omitempty"`
+	Async               *AsyncMode      `json:"async,omitempty"`
+	Mock                *Mock           `json:"mock,omitempty"`
+	Auth                *InboundAuth    `json:"auth,omitempty"`
+	Policy              *Policy         `json:"policy,omitempty"`
+	CORS                *CORSPolicy     `json:"cors,omitempty"`
+}
+
+// CORSPolicy lets browsers on AllowedOrigins call an API mapping. An API mapping's policy
+// replaces the global one. Without AllowedMethods, the methods of the path's API mappings
+// are allowed; without AllowedHeaders, any request header is. AllowCredentials cannot be
+// combined with the "*" origin.
+type CORSPolicy struct {
+	AllowedOrigins   []string `json:"allowedOrigins"`
+	AllowedMethods   []string `json:"allowedMethods,omitempty"`
+	AllowedHeaders   []string `json:"allowedHeaders,omitempty"`
+	ExposedHeaders   []string `json:"exposedHeaders,omitempty"`
+	AllowCredentials bool     `json:"allowCredentials,omitempty"`
+	MaxAge           Duration `json:"maxAge,omitempty"`
+}
+
+// Policy allows or denies requests to an API mapping. The first rule whose condition holds
+// decides; Default ("allow" or "deny") applies when none does. Denied requests get Response.
+type Policy struct {
+	Rules    []PolicyRule `json:"rules"`
+	Default  string       `json:"default,omitempty"`
+	Response *Response    `json:"response,omitempty"`
+}
+
+// PolicyRule allows or denies, by Effect, the requests for which When holds.
+type PolicyRule struct {
+	Name   string    `json:"name,omitempty"`
+	Effect string    `json:"effect"`
+	When   Condition `json:"when"`
+}
+
+// InboundAuth requires callers of an API mapping to send an API key or a JWT bearer token.
+// Callers without valid credentials get the Unauthorized response, and callers without all
+// of Scopes get the Forbidden response.
+type InboundAuth struct {
+	APIKey       *APIKeyAuth `json:"apiKey,omitempty"`
+	JWT          *JWTAuth    `json:"jwt,omitempty"`
+	Scopes       []string    `json:"scopes,omitempty"`
+	Unauthorized *Response   `json:"unauthorized,omitempty"`
+	Forbidden    *Response   `json:"forbidden,omitempty"`
+}
+
+// APIKeyAuth checks the API key sent in Header against the hashed keys of KeyFile.
+type APIKeyAuth struct {
+	Header  string `json:"header,omitempty"`
+	KeyFile string `json:"keyFile"`
+}
+
+// JWTAuth verifies bearer tokens with the keys of JWKSFile. Issuer and Audience are only
+// checked when set; Leeway allows for clock skew in the expiry checks.
+type JWTAuth struct {
+	JWKSFile string   `json:"jwksFile"`
+	Issuer   string   `json:"issuer,omitempty"`
+	Audience string   `json:"audience,omitempty"`
+	Leeway   Duration `json:"leeway,omitempty"`
+}
+
+// Mock answers the target calls of an API mapping from fixtures instead of calling the
+// targets, while the request and response mappings still run.
+type Mock struct {
+	Enabled  bool      `json:"enabled"`
+	Fixtures []Fixture `json:"fixtures,omitempty"`
+}
+
+// Fixture is a canned target response. Call is empty for the target, or names a step or
+// branch as "step.<name>" or "branch.<name>". The first fixture for the call whose When
+// condition holds is used. Body is sent as text when it is a string and as JSON otherwise;
+// BodyFile reads the body from a file instead.
+type Fixture struct {
+	Name     string            `json:"name,omitempty"`
+	Call     string            `json:"call,omitempty"`
+	When     *Condition        `json:"when,omitempty"`
+	Status   int               `json:"status,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Body     interface{}       `json:"body,omitempty"`
+	BodyFile string            `json:"bodyFile,omitempty"`
+}
+
+// AsyncMode answers requests at once with the Accepted response and delivers the mapped
+// response to the callback URL given in the request once the target has answered.
+// Callback URLs must use https and name one of AllowedHosts, or without AllowedHosts, a
+// public address. Other callback URLs are answered with OnInvalidCallback.
+type AsyncMode struct {
+	CallbackURL       string                 `json:"callbackUrl"`
+	Accepted          Response               `json:"accepted"`
+	AllowedHosts      []string               `json:"allowedHosts,omitempty"`
+	OnInvalidCallback *Response              `json:"onInvalidCallback,omitempty"`
+	Headers           map[string]interface{} `json:"headers,omitempty"`
+	Retry             *RetryPolicy           `json:"retry,omitempty"`
+	Signing           *RequestSigning        `json:"signing,omitempty"`
+}
+
+// FanOut calls several target APIs concurrently. PartialFailure is "failAll" (the default)
+// or "omit", which leaves out the fields mapped from failed branches.
+type FanOut struct {
+	Branches       []Branch  `json:"branches"`
+	PartialFailure string    `json:"partialFailure,omitempty"`
+	OnFailure      *Response `json:"onFailure,omitempty"`
+}
+
+// Branch is one named target call of a fan-out.
+type Branch struct {
+	Name           string         `json:"name"`
+	Target         APITarget      `json:"target"`
+	RequestMapping RequestMapping `json:"requestMapping"`
+	Timeout        Duration       `json:"timeout,omitempty"`
+	FailureStatus  []int          `json:"failureStatus,omitempty"`
+}
+
+// Step is a named target call made before the API mapping's own target. Later steps,
+// the target request and the response mapping can read its result.
+type Step struct {
+	Name              string         `json:"name"`
+	Target            APITarget      `json:"target"`
+	RequestMapping    RequestMapping `json:"requestMapping"`
+	When              *Condition     `json:"when,omitempty"`
+	FailureStatus     []int          `json:"failureStatus,omitempty"`
+	ContinueOnFailure bool           `json:"continueOnFailure,omitempty"`
+	OnFailure         *Response      `json:"onFailure,omitempty"`
+}
+
+// Condition is a test on a src: value. All and Any combine nested conditions.
+type Condition struct {
+	Source   string      `json:"source,omitempty"`
+	Operator string      `json:"operator,omitempty"`
+	Value    interface{} `json:"value,omitempty"`
+	All      []Condition `json:"all,omitempty"`
+	Any      []Condition `json:"any,omitempty"`
+}
+
+// RateLimit limits the requests of each consumer of an API mapping. Consumers are told
+// apart by the value of the Key source, such as an API key header or the client IP.
+// MaxConsumers caps the consumers tracked at once.
+type RateLimit struct {
+	Key          string    `json:"key"`
+	Rate         float64   `json:"rate,omitempty"`
+	Burst        int       `json:"burst,omitempty"`
+	Quota        *Quota    `json:"quota,omitempty"`
+	MaxConsumers int       `json:"maxConsumers,omitempty"`
+	Response     *Response `json:"response,omitempty"`
+}
+
+// Quota limits the number of requests of a consumer per calendar day or month, in UTC.
+type Quota struct {
+	Daily   int64 `json:"daily,omitempty"`
+	Monthly int64 `json:"monthly,omitempty"`
+}
+
+// Coalesce lets concurrent identical requests share one target call.
+type Coalesce struct {
+	Enabled bool     `json:"enabled"`
+	Key     []string `json:"key,omitempty"`
+}
+
+// ResponseCache defines how mapped responses of an API mapping are cached.
+type ResponseCache struct {
+	Key          []string `json:"key"`
+	TTL          Duration `json:"ttl"`
+	MaxEntries   int      `json:"maxEntries,omitempty"`
+	StaleIfError bool     `json:"staleIfError,omitempty"`
 }
 
 // APITarget represents the target API configuration.
 type APITarget struct {
-	URL     string                 `json:"url"`
-	Method  string                 `json:"method"`
-	Headers map[string]interface{} `json:"headers"`
+	URL            string                 `json:"url"`
+	Method         string                 `json:"method"`
+	Headers        map[string]interface{} `json:"headers"`
+	BodyFormat     string                 `json:"bodyFormat,omitempty"`
+	XML            *XMLBody               `json:"xml,omitempty"`
+	SOAP           *SOAPEnvelope          `json:"soap,omitempty"`
+	Timeouts       *Timeouts              `json:"timeouts,omitempty"`
+	Retry          *RetryPolicy           `json:"retry,omitempty"`
+	CircuitBreaker *CircuitBreaker        `json:"circuitBreaker,omitempty"`
+	Transport      *TransportSettings     `json:"transport,omitempty"`
+	TLS            *TLSSettings           `json:"tls,omitempty"`
+	Upstreams      *Upstreams             `json:"upstreams,omitempty"`
+	Bulkhead       *Bulkhead              `json:"bulkhead,omitempty"`
+	Auth           *TargetAuth            `json:"auth,omitempty"`
+	Signing        *RequestSigning        `json:"signing,omitempty"`
+}
+
+// RequestSigning signs requests to a target API. Algorithm is "hmac-sha256" (the default),
+// "rsa-sha256" or "ecdsa-sha256". Key is the HMAC secret or a PEM private key, written as is
+// or read with "src:env|NAME" or "src:file|path".
+type RequestSigning struct {
+	Algorithm       string   `json:"algorithm,omitempty"`
+	Key             string   `json:"key"`
+	Components      []string `json:"components,omitempty"`
+	Header          string   `json:"header,omitempty"`
+	TimestampHeader string   `json:"timestampHeader,omitempty"`
+	NonceHeader     string   `json:"nonceHeader,omitempty"`
+	Encoding        string   `json:"encoding,omitempty"`
+}
+
+// TargetAuth defines how the gateway authenticates to a target API.
+type TargetAuth struct {
+	OAuth2 *OAuth2ClientCredentials `json:"oauth2,omitempty"`
+}
+
+// OAuth2ClientCredentials fetches access tokens with the OAuth2 client credentials grant.
+// ClientID and ClientSecret may be read with "src:env|NAME" or "src:file|path". AuthStyle
+// is "basic" (the default) or "body".
+type OAuth2ClientCredentials struct {
+	TokenURL      string   `json:"tokenUrl"`
+	ClientID      string   `json:"clientId"`
+	ClientSecret  string   `json:"clientSecret"`
+	Scopes        []string `json:"scopes,omitempty"`
+	AuthStyle     string   `json:"authStyle,omitempty"`
+	RefreshBefore Duration `json:"refreshBefore,omitempty"`
+}
+
+// Bulkhead limits the calls in flight to a target API and what is answered when no
+// call can be made.
+type Bulkhead struct {
+	MaxConcurrent int       `json:"maxConcurrent"`
+	MaxQueue      int       `json:"maxQueue,omitempty"`
+	QueueTimeout  Duration  `json:"queueTimeout,omitempty"`
+	Response      *Response `json:"response,omitempty"`
+}
+
+// Upstreams defines several base URLs serving a target API and how to choose between them.
+type Upstreams struct {
+	Endpoints       []UpstreamEndpoint `json:"endpoints"`
+	Strategy        string             `json:"strategy,omitempty"`
+	HealthCheck     *HealthCheck       `json:"healthCheck,omitempty"`
+	OutlierEjection *OutlierEjection   `json:"outlierEjection,omitempty"`
+}
+
+// UpstreamEndpoint is one base URL of a target API.
+type UpstreamEndpoint struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight,omitempty"`
+}
+
+// HealthCheck defines the active health check of upstream endpoints.
+type HealthCheck struct {
+	Path           string   `json:"path"`
+	Interval       Duration `json:"interval,omitempty"`
+	Timeout        Duration `json:"timeout,omitempty"`
+	ExpectedStatus []int    `json:"expectedStatus,omitempty"`
+}
+
+// OutlierEjection defines when an upstream endpoint is taken out of rotation after failures.
+type OutlierEjection struct {
+	ConsecutiveFailures int      `json:"consecutiveFailures,omitempty"`
+	EjectionDuration    Duration `json:"ejectionDuration,omitempty"`
+}
+
+// ServerSettings defines the gateway's listeners. Addr is the plain HTTP listener, used
+// next to the TLS listener when both are set. AdminAddr serves the metrics; without it
+// they are not served.
+type ServerSettings struct {
+	Addr      string     `json:"addr,omitempty"`
+	AdminAddr string     `json:"adminAddr,omitempty"`
+	TLS       *ServerTLS `json:"tls,omitempty"`
+}
+
+// ServerTLS defines the HTTPS listener. ClientAuth is "request" to verify client
+// certificates when sent, or "require" to reject clients without one.
+type ServerTLS struct {
+	Addr         string `json:"addr,omitempty"`
+	CertFile     string `json:"certFile"`
+	KeyFile      string `json:"keyFile"`
+	ClientCAFile string `json:"clientCAFile,omitempty"`
+	ClientAuth   string `json:"clientAuth,omitempty"`
+	MinVersion   string `json:"minVersion,omitempty"`
+	DisableHTTP2 bool   `json:"disableHTTP2,omitempty"`
+}
+
+// TLSSettings defines how the gateway authenticates to and verifies a target API over TLS.
+type TLSSettings struct {
+	CertFile     string   `json:"certFile,omitempty"`
+	KeyFile      string   `json:"keyFile,omitempty"`
+	CAFile       string   `json:"caFile,omitempty"`
+	ServerName   string   `json:"serverName,omitempty"`
+	MinVersion   string   `json:"minVersion,omitempty"`
+	PinnedSHA256 []string `json:"pinnedSHA256,omitempty"`
+}
+
+// TransportSettings defines the connection pool used to call a target API.
+type TransportSettings struct {
+	MaxIdleConns           int      `json:"maxIdleConns,omitempty"`
+	MaxIdleConnsPerHost    int      `json:"maxIdleConnsPerHost,omitempty"`
+	MaxConnsPerHost        int      `json:"maxConnsPerHost,omitempty"`
+	IdleConnTimeout        Duration `json:"idleConnTimeout,omitempty"`
+	KeepAlive              Duration `json:"keepAlive,omitempty"`
+	DisableKeepAlives      bool     `json:"disableKeepAlives,omitempty"`
+	DisableHTTP2           bool     `json:"disableHTTP2,omitempty"`
+	MaxResponseHeaderBytes int64    `json:"maxResponseHeaderBytes,omitempty"`
+}
+
+// CircuitBreaker defines when calls to a failing target API are stopped and what is
+// answered instead while the circuit is open.
+type CircuitBreaker struct {
+	FailureThreshold int       `json:"failureThreshold"`
+	OpenDuration     Duration  `json:"openDuration"`
+	HalfOpenProbes   int       `json:"halfOpenProbes"`
+	FailureStatus    []int     `json:"failureStatus,omitempty"`
+	Response         *Response `json:"response,omitempty"`
+}
+
+// RetryPolicy defines when and how often a failed call to the target API is repeated.
+type RetryPolicy struct {
+	MaxAttempts            int                      `json:"maxAttempts"`
+	InitialBackoff         Duration                 `json:"initialBackoff"`
+	MaxBackoff             Duration                 `json:"maxBackoff"`
+	Multiplier             float64                  `json:"multiplier"`
+	RetryOnStatus          []int                    `json:"retryOnStatus"`
+	RetryOnBody            map[string][]interface{} `json:"retryOnBody"`
+	RetryOnTransportErrors []string                 `json:"retryOnTransportErrors"`
+	RetryNonIdempotent     bool                     `json:"retryNonIdempotent"`
+}
+
+// Timeouts defines the time limits of a call to the target API.
+type Timeouts struct {
+	Connect        Duration `json:"connect,omitempty"`
+	TLSHandshake   Duration `json:"tlsHandshake,omitempty"`
+	ResponseHeader Duration `json:"responseHeader,omitempty"`
+	Total          Duration `json:"total,omitempty"`
+}
+
+// XMLBody defines how the mapped request body is rendered for an "xml" target.
+type XMLBody struct {
+	RootElement string            `json:"rootElement"`
+	Namespaces  map[string]string `json:"namespaces"`
+}
+
+// SOAPEnvelope defines the envelope wrapped around the mapped request body for a "soap" target.
+type SOAPEnvelope struct {
+	Version    string                 `json:"version"`
+	Action     string                 `json:"action"`
+	Namespaces map[string]string      `json:"namespaces"`
+	Header     map[string]interface{} `json:"header,omitempty"`
 }
 
 // RequestMapping defines how to map request data.
 type RequestMapping struct {
-	QueryParam  map[string]interface{} `json:"queryParam,omitempty"`
-	RequestBody map[string]interface{} `json:"requestBody"`
+	QueryParam       map[string]interface{} `json:"queryParam,omitempty"`
+	RequestBody      map[string]interface{} `json:"requestBody"`
+	RequestBodyOrder map[string][]string    `json:"-"`
+
+	OnUnsupportedMediaType *Response `json:"onUnsupportedMediaType,omitempty"`
 }
 
 // ResponseMapping defines how to map response data.
 type ResponseMapping struct {
-	ByHTTPStatusCode ByHTTPStatusCode `json:"byHTTPStatusCode"`
-	ByBodyResponse   ByBodyResponse   `json:"byBodyResponse"`
+	ByHTTPStatusCode      ByHTTPStatusCode    `json:"byHTTPStatusCode"`
+	ByBodyResponse        ByBodyResponse      `json:"byBodyResponse"`
+	OnTransportError      map[string]Response `json:"onTransportError,omitempty"`
+	OnUnparseableResponse *Response           `json:"onUnparseableResponse,omitempty"`
 }
 
 // ByBodyResponse defines custom response mappings.
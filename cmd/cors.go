@@ -0,0 +1,159 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// corsPolicy returns the CORS policy of an API mapping, its own or else the global one.
+func corsPolicy(endpoint conf.APIEndpoint) *conf.CORSPolicy {
+	if endpoint.CORS != nil {
+		return endpoint.CORS
+	}
+	return config.CORS
+}
+
+// handlePreflight answers a CORS preflight request for an API mapping of the path, and
+// returns false when the request is not a preflight or no mapping of the path has a policy.
+// Disallowed origins, methods or headers get an answer without CORS headers, so the
+// browser blocks the request.
+func handlePreflight(w http.ResponseWriter, r *http.Request) bool {
+	method := r.Header.Get("Access-Control-Request-Method")
+	if r.Method != http.MethodOptions || method == "" {
+		return false
+	}
+
+	// The policy of the API mapping for the requested method applies, or else the first one.
+	var (
+		policy         *conf.CORSPolicy
+		matched        bool
+		allowedMethods []string
+	)
+	for _, endpoint := range config.APIMappings {
+		p := corsPolicy(endpoint)
+		if endpoint.Source.URL != r.URL.Path || p == nil {
+			continue
+		}
+		allowedMethods = append(allowedMethods, endpoint.Source.Method)
+		if !matched {
+			policy = p
+			matched = endpoint.Source.Method == method
+		}
+	}
+	if policy == nil {
+		return false
+	}
+	if len(policy.AllowedMethods) > 0 {
+		allowedMethods = policy.AllowedMethods
+	}
+
+	origin := r.Header.Get("Origin")
+	requested := r.Header.Get("Access-Control-Request-Headers")
+	w.Header().Add("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+	switch {
+	case !isAllowedOrigin(policy, origin):
+		fmt.Printf("CORS PREFLIGHT REJECTED: origin %s\n", origin)
+	case !containsFold(allowedMethods, method):
+		fmt.Printf("CORS PREFLIGHT REJECTED: method %s\n", method)
+	case !allowsHeaders(policy, requested):
+		fmt.Printf("CORS PREFLIGHT REJECTED: headers %s\n", requested)
+	default:
+		setAllowOrigin(w, policy, origin)
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(allowedMethods, ", "))
+		if len(policy.AllowedHeaders) > 0 {
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(policy.AllowedHeaders, ", "))
+		} else if requested != "" {
+			w.Header().Set("Access-Control-Allow-Headers", requested)
+		}
+		if maxAge := policy.MaxAge.Duration(); maxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(maxAge.Seconds())))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// addCORSHeaders adds the CORS headers of an API mapping to its response when the request
+// comes from an allowed origin.
+func addCORSHeaders(w http.ResponseWriter, r *http.Request, endpoint conf.APIEndpoint) {
+	policy := corsPolicy(endpoint)
+	if policy == nil {
+		return
+	}
+	origin := r.Header.Get("Origin")
+	w.Header().Add("Vary", "Origin")
+	if origin == "" || !isAllowedOrigin(policy, origin) {
+		return
+	}
+	setAllowOrigin(w, policy, origin)
+	if len(policy.ExposedHeaders) > 0 {
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(policy.ExposedHeaders, ", "))
+	}
+}
+
+// setAllowOrigin allows an origin, or every origin when "*" is allowed, and allows
+// credentials when configured. Credentials are never allowed for "*".
+func setAllowOrigin(w http.ResponseWriter, policy *conf.CORSPolicy, origin string) {
+	if containsFold(policy.AllowedOrigins, "*") {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if policy.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// validateCORS rejects a policy that would let every origin make credentialed requests.
+func validateCORS(policy *conf.CORSPolicy) error {
+	if policy.AllowCredentials && containsFold(policy.AllowedOrigins, "*") {
+		return fmt.Errorf("cors: allowCredentials needs explicit allowedOrigins, not \"*\"")
+	}
+	return nil
+}
+
+// isAllowedOrigin reports whether an origin is allowed. Allowed origins are "*", exact
+// origins, or patterns with one "*" such as "https://*.example.com".
+func isAllowedOrigin(policy *conf.CORSPolicy, origin string) bool {
+	if origin == "" {
+		return false
+	}
+	for _, allowed := range policy.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		if prefix, suffix, ok := strings.Cut(allowed, "*"); ok &&
+			len(origin) > len(prefix)+len(suffix) &&
+			strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsHeaders reports whether every requested header is allowed. Without AllowedHeaders,
+// any header is.
+func allowsHeaders(policy *conf.CORSPolicy, requested string) bool {
+	if len(policy.AllowedHeaders) == 0 || containsFold(policy.AllowedHeaders, "*") {
+		return true
+	}
+	for _, header := range strings.Split(requested, ",") {
+		if header = strings.TrimSpace(header); header != "" && !containsFold(policy.AllowedHeaders, header) {
+			return false
+		}
+	}
+	return true
+}
+
+// containsFold reports whether a list contains a value, ignoring case.
+func containsFold(list []string, value string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
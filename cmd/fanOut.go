@@ -0,0 +1,100 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// partialFailureOmit is the fan-out policy that leaves out failed branches instead of
+// failing the whole request.
+const partialFailureOmit = "omit"
+
+// runFanOut calls the branches of an API mapping concurrently and stores their results.
+// With the omit policy, failed branches are recorded as omitted and the fields
+// mapped from them are left out. With failAll, a failed branch answers the request: it
+// returns the failed branch's result, and handled is true when the response has been sent.
+func runFanOut(w http.ResponseWriter, r *http.Request, endpoint conf.APIEndpoint) (failed *targetResult, handled bool) {
+	fanOut := endpoint.FanOut
+	if fanOut == nil || len(fanOut.Branches) == 0 {
+		return nil, false
+	}
+
+	// Map every branch request and its headers first, so the branch calls map nothing.
+	// Mocked branches are answered by their fixtures straight away.
+	bodies := make([][]byte, len(fanOut.Branches))
+	headers := make([]http.Header, len(fanOut.Branches))
+	results := make([]targetResult, len(fanOut.Branches))
+	mocked := make([]bool, len(fanOut.Branches))
+	for i, branch := range fanOut.Branches {
+		results[i], mocked[i] = mockTargetResult(endpoint, "branch."+branch.Name, branch.Target, r)
+		reqBody := mapData(branch.RequestMapping.RequestBody, r, r.Header)
+		body, bodyHeaders, err := encodeTargetBody(branch.Target, reqBody, branch.RequestMapping.RequestBodyOrder, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return nil, true
+		}
+		bodies[i], headers[i] = body, targetHeaders(branch.Target, bodyHeaders, r)
+	}
+
+	var wg sync.WaitGroup
+	for i, branch := range fanOut.Branches {
+		if mocked[i] {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, branch conf.Branch) {
+			defer wg.Done()
+			br := r
+			if timeout := branch.Timeout.Duration(); timeout > 0 {
+				ctx, cancel := context.WithTimeout(r.Context(), timeout)
+				defer cancel()
+				br = r.WithContext(ctx)
+			}
+			results[i] = callTarget(branch.Target, bodies[i], headers[i], br)
+		}(i, branch)
+	}
+	wg.Wait()
+	rc := getRequestContext(r)
+
+	for i, branch := range fanOut.Branches {
+		result := results[i]
+		result.target = branch.Target
+		fmt.Printf("BRANCH %s: %d\n", branch.Name, result.status)
+		if !isCallFailure(branch.FailureStatus, result) {
+			rc.targetResults["branch."+branch.Name] = result
+			continue
+		}
+
+		fmt.Printf("BRANCH FAILED: %s %v\n", branch.Name, result.err)
+		if fanOut.PartialFailure == partialFailureOmit {
+			rc.omittedBranches[branch.Name] = true
+			continue
+		}
+		rc.targetResults["branch."+branch.Name] = result
+		if fanOut.OnFailure != nil {
+			writeMappedResponse(w, r, *fanOut.OnFailure)
+			return &result, true
+		}
+		if result.err != nil {
+			writeTransportErrorResponse(w, r, endpoint, branch.Target, result.err)
+			return &result, true
+		}
+		return &result, false
+	}
+	return nil, false
+}
+
+// isOmittedSource reports whether a mapping reads a branch that failed under the omit
+// policy, so its field is left out.
+func isOmittedSource(r *http.Request, val string) bool {
+	if !strings.HasPrefix(val, srcBranchPrefix) {
+		return false
+	}
+	srcType := strings.SplitN(val, "|", 2)[0]
+	name, _, _ := isTargetResultSource(srcType)
+	return getRequestContext(r).omittedBranches[strings.TrimPrefix(name, "branch.")]
+}
@@ -3,6 +3,7 @@ package main
 import (
 	conf "api-mapping-customization-guide/cmd/config"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,17 +13,27 @@ import (
 	"plugin"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/tidwall/gjson"
 )
 
 // Define global variables
 var (
-	requestBodyJSON  gjson.Result
-	responseBodyJSON gjson.Result
-	config           conf.Configuration
+	config conf.Configuration
 )
 
+// sourcesWithoutValue lists the source types that may be written without "|value".
+var sourcesWithoutValue = map[string]bool{
+	"src:res_raw": true,
+}
+
+// isSourceWithoutValue reports whether a source may be written without "|value".
+func isSourceWithoutValue(val string) bool {
+	_, field, ok := isTargetResultSource(val)
+	return sourcesWithoutValue[val] || ok && (field == "status" || field == "res_raw")
+}
+
 // PluginInterface is the interface for custom plugin functions.
 type PluginInterface interface {
 	Execute(args ...interface{}) interface{}
@@ -32,6 +43,20 @@ type PluginInterface interface {
 func HandleAPIRequest(w http.ResponseWriter, r *http.Request, endpoint conf.APIEndpoint) {
 	fmt.Println("Received request for API:", endpoint.Name)
 
+	// Target calls end when the client goes away or its deadline passes.
+	r, cancel := withClientDeadline(r)
+	defer cancel()
+	r, rc := withRequestContext(r)
+
+	// Remove the temporary files of a multipart body once the request is answered. An
+	// asynchronous request removes them itself after its target call.
+	async := false
+	defer func() {
+		if !async {
+			rc.removeMultipartFiles()
+		}
+	}()
+
 	// Translate query parameters
 	if len(endpoint.RequestMapping.QueryParam) > 0 {
 		for key, value := range endpoint.RequestMapping.QueryParam {
@@ -52,25 +77,126 @@ func HandleAPIRequest(w http.ResponseWriter, r *http.Request, endpoint conf.APIE
 		}
 	}
 
+	// Reject callers without valid credentials for the API mapping before reading their body.
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	if !authenticate(w, r, endpoint) {
+		return
+	}
+
 	rBody, err := ioutil.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer r.Body.Close()
-	requestBodyJSON = gjson.Parse(string(rBody))
+	rc.bodyRaw = rBody
 
-	// Convert request body to JSON
-	reqBody := mapData(endpoint.RequestMapping.RequestBody, r, r.Header)
-	requestBody, err := json.Marshal(reqBody)
+	// Parse the request body according to its Content-Type.
+	rc.bodyJSON, err = parseRequestBody(r, rBody)
+	if errors.Is(err, errUnsupportedMediaType) {
+		writeUnsupportedMediaTypeResponse(w, r, endpoint)
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Deny requests the API mapping's policy does not allow.
+	if !authorize(w, r, endpoint) {
 		return
 	}
 
-	code, err := performTargetRequest(endpoint.Target, requestBody, r)
+	// Reject consumers over their rate limit or quota.
+	if !checkRateLimit(w, r, endpoint) {
+		return
+	}
+
+	// Accept asynchronous requests at once and deliver the mapped response to their callback.
+	if async = dispatchAsyncRequest(w, r, endpoint); async {
+		return
+	}
+
+	// Answer from the cache when the same lookup was mapped recently.
+	cache := endpointCache(endpoint)
+	var key string
+	if cache != nil {
+		key = cacheKey(endpoint, r)
+		if serveCachedResponse(w, endpoint, cache, key) {
+			return
+		}
+	}
+
+	handleMappedRequest(w, r, endpoint, cache, key)
+}
+
+// handleMappedRequest calls the steps, branches and target of an API mapping and sends the
+// mapped response. Successful responses are stored in the cache, when there is one.
+func handleMappedRequest(w http.ResponseWriter, r *http.Request, endpoint conf.APIEndpoint, cache *responseCache, key string) {
+	// Call the steps that come before the target, in order.
+	lastStep, stopped, handled := runSteps(w, r, endpoint)
+	if handled {
+		return
+	}
+
+	// Call the fan-out branches concurrently, unless a failed step stopped the chain.
+	var failedBranch *targetResult
+	if !stopped {
+		failedBranch, handled = runFanOut(w, r, endpoint)
+		if handled {
+			return
+		}
+	}
+
+	var (
+		code int
+		err  error
+		// called is the target whose result is mapped.
+		called = endpoint.Target
+	)
+	if stopped {
+		// The failed step stands in for the target.
+		code, err = useTargetResult(r, lastStep)
+		called = lastStep.target
+	} else if failedBranch != nil {
+		// The failed branch stands in for the target.
+		code, err = useTargetResult(r, failedBranch)
+		called = failedBranch.target
+	} else if endpoint.Target.URL == "" && endpoint.FanOut != nil {
+		// Without a target, the branches are mapped as a successful response.
+		code, err = useTargetResult(r, &targetResult{status: http.StatusOK})
+	} else if endpoint.Target.URL == "" {
+		// The last step called stands in for the target.
+		code, err = useTargetResult(r, lastStep)
+		if lastStep != nil {
+			called = lastStep.target
+		}
+	} else {
+		// Convert request body to the target's body format
+		reqBody := mapData(endpoint.RequestMapping.RequestBody, r, r.Header)
+		requestBody, bodyHeaders, encodeErr := encodeTargetBody(endpoint.Target, reqBody, endpoint.RequestMapping.RequestBodyOrder, r)
+		if encodeErr != nil {
+			http.Error(w, encodeErr.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if result, mocked := mockTargetResult(endpoint, "", endpoint.Target, r); mocked {
+			code, err = useTargetResult(r, &result)
+		} else {
+			code, err = coalescedTargetRequest(endpoint, requestBody, targetHeaders(endpoint.Target, bodyHeaders, r), r)
+		}
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		if serveStaleResponse(w, endpoint, cache, key) {
+			return
+		}
+		// Never leak the raw transport error to the requester, map it instead.
+		writeTransportErrorResponse(w, r, endpoint, called, err)
 		return
 	}
 
@@ -96,9 +222,18 @@ func HandleAPIRequest(w http.ResponseWriter, r *http.Request, endpoint conf.APIE
 			httpResponse = code
 		}
 	} else if mappingType == "byBodyResponse" {
+		// A body that could not be parsed cannot be mapped by its content.
+		if parseErr := getRequestContext(r).responseParseErr; parseErr != nil {
+			if serveStaleResponse(w, endpoint, cache, key) {
+				return
+			}
+			writeTransportErrorResponse(w, r, endpoint, called, parseErr)
+			return
+		}
+
 		// Handle response mapping by body response
 		for key := range endpoint.ResponseMapping.ByBodyResponse.Custom {
-			responseValue := responseBodyJSON.Get(key).Value()
+			responseValue := getRequestContext(r).responseJSON.Get(key).Value()
 			responseMapping := endpoint.ResponseMapping
 
 			// Define a function to process the response based on a key
@@ -129,7 +264,23 @@ func HandleAPIRequest(w http.ResponseWriter, r *http.Request, endpoint conf.APIE
 		}
 	}
 
-	//Convert response to JSON and send it.
+	// A failing target is answered from the cache when stale entries are allowed.
+	if httpResponse >= 500 && serveStaleResponse(w, endpoint, cache, key) {
+		return
+	}
+	storeCachedResponse(endpoint, cache, key, httpResponse, response)
+
+	writeJSONResponse(w, httpResponse, response)
+}
+
+// writeMappedResponse maps a configured response and sends it to the requester.
+func writeMappedResponse(w http.ResponseWriter, r *http.Request, res conf.Response) {
+	response := mapData(res.JSONBody, r, r.Header)
+	writeJSONResponse(w, res.HTTPStatusCode, response)
+}
+
+// writeJSONResponse converts the response to JSON and sends it.
+func writeJSONResponse(w http.ResponseWriter, httpResponse int, response interface{}) {
 	jsonResponse, err := json.Marshal(response)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -144,34 +295,115 @@ func HandleAPIRequest(w http.ResponseWriter, r *http.Request, endpoint conf.APIE
 	_, _ = w.Write(jsonResponse)
 }
 
-// performTargetRequest performs the HTTP request to the target API.
-func performTargetRequest(target conf.APITarget, reqBodyJSON []byte, r *http.Request) (int, error) {
-	// Create an HTTP client.
-	client := &http.Client{}
+// performTargetRequest performs the HTTP request to the target API and makes its response
+// the one the response mapping reads.
+func performTargetRequest(target conf.APITarget, reqBody []byte, headers http.Header, r *http.Request) (int, error) {
+	result := callTarget(target, reqBody, headers, r)
+	return useTargetResult(r, &result)
+}
 
-	// Prepare the request based on the target configuration.
-	req, err := http.NewRequest(target.Method, target.URL, strings.NewReader(string(reqBodyJSON)))
+// callTarget performs the HTTP request to the target API with headers mapped by
+// targetHeaders, retrying it according to the target's retry policy. It does not map
+// anything, so calls may run concurrently.
+func callTarget(target conf.APITarget, reqBody []byte, headers http.Header, r *http.Request) targetResult {
+	// Get the HTTP client for the target.
+	client, err := targetClient(target)
 	if err != nil {
-		return 0, err
+		return targetResult{err: &transportError{class: transportErrorTLS, err: err}}
 	}
+	maxAttempts := retryAttempts(target)
+	breaker := targetCircuitBreaker(target)
+	slots := targetBulkhead(target)
+
+	for attempt := 1; ; attempt++ {
+		// Wait for a free slot when the target has too many calls in flight.
+		if slots != nil {
+			if err := slots.acquire(r.Context()); err != nil {
+				recordTargetAttempts(target, attempt-1)
+				return targetResult{err: err}
+			}
+		}
 
-	// Copy headers from the target configuration to the request.
-	for key, v := range target.Headers {
-		val := fmt.Sprint(mapData(v, r, r.Header))
-		req.Header.Set(key, val)
+		// An open circuit answers without calling the target.
+		if breaker != nil && !breaker.allow() {
+			if slots != nil {
+				slots.release()
+			}
+			recordTargetAttempts(target, attempt-1)
+			return targetResult{err: &transportError{class: transportErrorCircuitOpen, err: errCircuitOpen}}
+		}
+
+		var result targetResult
+		result.status, result.err = doUpstreamRequest(client, target, reqBody, headers, r, &result)
+		code, err := result.status, result.err
+		if slots != nil {
+			slots.release()
+		}
+		// A client that gave up says nothing about the health of the target, so only its
+		// probe slot is returned.
+		if breaker != nil {
+			if r.Context().Err() != nil {
+				breaker.release()
+			} else {
+				breaker.record(!isTargetFailure(breaker.settings, code, err))
+			}
+		}
+
+		if attempt >= maxAttempts || !shouldRetry(target.Retry, code, err, result.bodyJSON) {
+			fmt.Printf("TARGET ATTEMPTS: %d\n", attempt)
+			recordTargetAttempts(target, attempt)
+			return result
+		}
+
+		// Wait before the next attempt, unless the client gives up first.
+		backoff := retryBackoff(target.Retry, attempt)
+		fmt.Printf("RETRYING TARGET in %s (attempt %d of %d)\n", backoff, attempt+1, maxAttempts)
+		select {
+		case <-time.After(backoff):
+		case <-r.Context().Done():
+			fmt.Printf("TARGET ATTEMPTS: %d\n", attempt)
+			recordTargetAttempts(target, attempt)
+			return result
+		}
 	}
+}
 
-	fmt.Println("REQUEST TO TARGET:")
-	dump, err := httputil.DumpRequest(req, true)
+// doTargetRequest performs a single HTTP request to the target API at targetURL and
+// stores the parsed response body in result.
+func doTargetRequest(client *http.Client, target conf.APITarget, targetURL string, reqBody []byte, headers http.Header, r *http.Request, result *targetResult) (int, error) {
+	// Forget the response of any previous attempt.
+	result.bodyJSON = gjson.Result{}
+	result.bodyRaw = ""
+	result.parseErr = nil
+
+	tokens, err := targetTokenSource(target)
 	if err != nil {
-		fmt.Println("Error dumping request:", err)
+		return 0, err
+	}
+	req, err := newTargetRequest(target, targetURL, reqBody, headers, r, tokens)
+	if err != nil {
+		return 0, err
 	}
-	fmt.Println(string(dump))
 
 	// Perform the HTTP request.
 	resp, err := client.Do(req)
 	if err != nil {
-		return 0, err
+		return 0, &transportError{class: classifyTransportError(err), err: err}
+	}
+
+	// A rejected access token is refreshed and the request sent once more.
+	if resp.StatusCode == http.StatusUnauthorized && tokens != nil {
+		_ = resp.Body.Close()
+		fmt.Println("OAUTH2 TOKEN rejected, refreshing")
+		tokens.invalidate(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+		req, err = newTargetRequest(target, targetURL, reqBody, headers, r, tokens)
+		if err != nil {
+			return 0, err
+		}
+		resp, err = client.Do(req)
+		if err != nil {
+			return 0, &transportError{class: classifyTransportError(err), err: err}
+		}
 	}
 	defer func(Body io.ReadCloser) {
 		_ = Body.Close()
@@ -185,16 +417,106 @@ func performTargetRequest(target conf.APITarget, reqBodyJSON []byte, r *http.Req
 	body, err := io.ReadAll(resp.Body)
 	fmt.Println("RESPONSE BODY TARGET:", string(body))
 	if err != nil {
-		return 0, err
+		class := classifyTransportError(err)
+		if class == transportErrorDefault {
+			class = transportErrorParse
+		}
+		return 0, &transportError{class: class, err: err}
 	}
 	defer resp.Body.Close()
 
-	// Unmarshal the response JSON into a gjson.Result.
-	responseBodyJSON = gjson.Parse(string(body))
+	// Parse the response body according to its Content-Type. A body that cannot be parsed
+	// keeps its status; only mappings that read the body treat it as a failure.
+	result.bodyRaw = string(body)
+	result.bodyJSON, err = parseResponseBody(resp.Header.Get("Content-Type"), body)
+	if err != nil {
+		result.parseErr = &transportError{class: transportErrorParse, err: err}
+		return code, nil
+	}
+	if target.BodyFormat == bodyFormatSOAP {
+		result.bodyJSON = unwrapSOAPBody(result.bodyJSON)
+	}
 
 	return code, nil
 }
 
+// targetHeaders maps the configured headers of a target over the headers describing the
+// encoded body. Headers without a value are left out.
+func targetHeaders(target conf.APITarget, bodyHeaders http.Header, r *http.Request) http.Header {
+	headers := bodyHeaders.Clone()
+	if headers == nil {
+		headers = make(http.Header)
+	}
+	for key, v := range target.Headers {
+		mapped := mapData(v, r, r.Header)
+		if mapped == nil {
+			// Leave out headers without a value rather than sending "<nil>".
+			fmt.Printf("Header %s has no value, not sent\n", key)
+			continue
+		}
+		headers.Set(key, fmt.Sprint(mapped))
+	}
+	return headers
+}
+
+// newTargetRequest prepares a request to the target API with the mapped headers, bound to
+// the inbound request.
+func newTargetRequest(target conf.APITarget, targetURL string, reqBody []byte, headers http.Header, r *http.Request, tokens *tokenSource) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(r.Context(), target.Method, targetURL, strings.NewReader(string(reqBody)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = headers.Clone()
+
+	// Authenticate with an access token when the target uses OAuth2.
+	if tokens != nil {
+		token, err := tokens.get(r.Context())
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	// Sign the request last, so the signature can cover every header.
+	if target.Signing != nil {
+		if err := signTargetRequest(req, reqBody, target.Signing); err != nil {
+			return nil, err
+		}
+	}
+
+	fmt.Println("REQUEST TO TARGET:")
+	fmt.Println(string(dumpTargetRequest(req, target.Signing)))
+	return req, nil
+}
+
+// dumpTargetRequest dumps a target request for the log with its credentials and signature
+// redacted.
+func dumpTargetRequest(req *http.Request, signing *conf.RequestSigning) []byte {
+	headers := req.Header
+	defer func() { req.Header = headers }()
+
+	req.Header = headers.Clone()
+	redacted := []string{"Authorization", "Proxy-Authorization"}
+	if signing != nil {
+		signatureHeader := signing.Header
+		if signatureHeader == "" {
+			signatureHeader = defaultSignatureHeader
+		}
+		redacted = append(redacted, signatureHeader)
+	}
+	for _, name := range redacted {
+		if req.Header.Get(name) != "" {
+			req.Header.Set(name, "REDACTED")
+		}
+	}
+
+	dump, err := httputil.DumpRequest(req, true)
+	if err != nil {
+		fmt.Println("Error dumping request:", err)
+	}
+	return dump
+}
+
 // mapData maps data based on a data mapping configuration.
 func mapData(dataMapping interface{}, r *http.Request, header http.Header) interface{} {
 	switch mapping := dataMapping.(type) {
@@ -207,6 +529,10 @@ func mapData(dataMapping interface{}, r *http.Request, header http.Header) inter
 		for key, value := range mapping {
 			switch val := value.(type) {
 			case string:
+				// Leave out fields of branches omitted after a failure
+				if isOmittedSource(r, val) {
+					continue
+				}
 				// Handle string data mapping
 				result[key] = handleStringDataMapping(val, r, header)
 			case map[string]interface{}:
@@ -239,6 +565,9 @@ func mapData(dataMapping interface{}, r *http.Request, header http.Header) inter
 // handleStringDataMapping handles string-based data mapping.
 func handleStringDataMapping(val string, r *http.Request, header http.Header) interface{} {
 	parts := strings.SplitN(val, "|", 2)
+	if len(parts) == 1 && isSourceWithoutValue(val) {
+		parts = append(parts, "")
+	}
 	if len(parts) != 2 {
 		fmt.Printf("Invalid format for data mapping: %s\n", val)
 		return nil
@@ -246,6 +575,12 @@ func handleStringDataMapping(val string, r *http.Request, header http.Header) in
 
 	srcType := parts[0]
 	srcValue := parts[1]
+	rc := getRequestContext(r)
+
+	// Map from the result of an earlier step
+	if name, field, ok := isTargetResultSource(srcType); ok {
+		return getTargetResultValue(rc, name, field, srcValue)
+	}
 
 	switch srcType {
 	case "src:static":
@@ -262,7 +597,7 @@ func handleStringDataMapping(val string, r *http.Request, header http.Header) in
 		}
 	case "src:req_body":
 		// Map from the request body
-		if requestBodyJSON.Raw == "" {
+		if rc.bodyJSON.Raw == "" {
 			requestBody, err := io.ReadAll(r.Body)
 			if err != nil {
 				return nil
@@ -270,17 +605,38 @@ func handleStringDataMapping(val string, r *http.Request, header http.Header) in
 			defer r.Body.Close()
 
 			// Parse JSON data using gjson
-			requestBodyJSON = gjson.ParseBytes(requestBody)
+			rc.bodyJSON = gjson.ParseBytes(requestBody)
 		}
-		return getKeyValueReq(srcValue)
+		return getKeyValueReq(rc, srcValue)
 	case "src:res_body":
 		// Map from the response body
-		return getValueKeyRes(srcValue)
+		return getValueKeyRes(rc, srcValue)
+	case "src:res_raw":
+		// Map the raw response body as text
+		return rc.responseRaw
 	case "src:query":
 		// Map from query parameters
 		if r.URL != nil {
 			return r.URL.Query().Get(srcValue)
 		}
+	case "src:req_form":
+		// Map a field of an inbound form or multipart request
+		return getRequestFormValue(rc, srcValue)
+	case "src:req_file":
+		// Map a file from an inbound multipart request
+		return getRequestFile(r, srcValue)
+	case "src:env":
+		// Map from an environment variable
+		return getEnvValue(srcValue)
+	case "src:file":
+		// Map from the contents of a file
+		return getFileValue(srcValue)
+	case "src:auth":
+		// Map a claim of the authenticated caller
+		return getAuthClaim(rc, srcValue)
+	case "src:client":
+		// Map a property of the requesting client
+		return getClientValue(r, srcValue)
 	case "src:req_header":
 		// Map from request headers
 		if r.Header != nil {
@@ -338,8 +694,8 @@ func handleStringDataMapping(val string, r *http.Request, header http.Header) in
 }
 
 // getKeyValueReq retrieves a key from the request body.
-func getKeyValueReq(key string) interface{} {
-	result := requestBodyJSON.Get(key)
+func getKeyValueReq(rc *requestContext, key string) interface{} {
+	result := rc.bodyJSON.Get(key)
 	if !result.Exists() {
 		return nil
 	}
@@ -347,8 +703,8 @@ func getKeyValueReq(key string) interface{} {
 }
 
 // getValueKeyRes retrieves a key from the response body.
-func getValueKeyRes(key string) interface{} {
-	result := responseBodyJSON.Get(key)
+func getValueKeyRes(rc *requestContext, key string) interface{} {
+	result := rc.responseJSON.Get(key)
 	if result.Exists() {
 		return result.Value()
 	}
@@ -417,10 +773,21 @@ func main() {
 		fmt.Println("Failed to parse config.json:", err)
 		return
 	}
+	if err := validateConfig(config); err != nil {
+		fmt.Println("Invalid config.json:", err)
+		return
+	}
+
+	// Deliver the callbacks a previous run left undelivered.
+	resumeOutbox()
+
+	// Start the HTTP and HTTPS listeners.
+	err = serve(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Answer CORS preflight requests for the API mappings of the path.
+		if handlePreflight(w, r) {
+			return
+		}
 
-	// Start the HTTP server on port 8082.
-	fmt.Println("Listening on :8082...")
-	http.ListenAndServe(":8082", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Determine which API endpoint to use based on the request path or other criteria.
 		var matchedEndpoint conf.APIEndpoint
 
@@ -439,6 +806,10 @@ func main() {
 		}
 
 		// Handle the API request using the matched endpoint.
+		addCORSHeaders(w, r, matchedEndpoint)
 		HandleAPIRequest(w, r, matchedEndpoint)
-	}))
+	}), config.Server)
+	if err != nil {
+		fmt.Println("Failed to start the server:", err)
+	}
 }
@@ -0,0 +1,25 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"expvar"
+)
+
+// metricsPath is where the admin listener publishes the gateway metrics as JSON.
+const metricsPath = "/debug/vars"
+
+// Metrics published on metricsPath, keyed by target URL.
+var (
+	targetRequestsMetric = expvar.NewMap("target_requests")
+	targetAttemptsMetric = expvar.NewMap("target_attempts")
+	targetRetriesMetric  = expvar.NewMap("target_retries")
+)
+
+// recordTargetAttempts records the number of attempts made for one target call.
+func recordTargetAttempts(target conf.APITarget, attempts int) {
+	targetRequestsMetric.Add(target.URL, 1)
+	targetAttemptsMetric.Add(target.URL, int64(attempts))
+	if attempts > 1 {
+		targetRetriesMetric.Add(target.URL, int64(attempts-1))
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// errNoFixture is the error of a mocked call that no fixture matches.
+var errNoFixture = errors.New("no mock fixture matches the request")
+
+// mockedCallsMetric counts target calls answered by fixtures, keyed by API mapping name.
+var mockedCallsMetric = expvar.NewMap("mocked_calls")
+
+// isMocked reports whether the target calls of an API mapping are answered by fixtures,
+// because the API mapping or the whole gateway is in mock mode.
+func isMocked(endpoint conf.APIEndpoint) bool {
+	if endpoint.Mock != nil && endpoint.Mock.Enabled {
+		return true
+	}
+	return config.MockMode
+}
+
+// mockTargetResult answers a call of an API mapping from the first fixture for the call
+// whose condition holds. The call is "" for the target, or "step.<name>" or "branch.<name>".
+// It returns false when the API mapping is not mocked and the call must be made.
+func mockTargetResult(endpoint conf.APIEndpoint, call string, target conf.APITarget, r *http.Request) (targetResult, bool) {
+	if !isMocked(endpoint) {
+		return targetResult{}, false
+	}
+	mockedCallsMetric.Add(endpoint.Name, 1)
+
+	var fixtures []conf.Fixture
+	if endpoint.Mock != nil {
+		fixtures = endpoint.Mock.Fixtures
+	}
+	for _, fixture := range fixtures {
+		if fixture.Call != call || (fixture.When != nil && !evaluateCondition(*fixture.When, r)) {
+			continue
+		}
+		fmt.Printf("MOCK %s %s: fixture %s\n", endpoint.Name, call, fixture.Name)
+		return fixtureResult(fixture, target), true
+	}
+
+	fmt.Printf("MOCK %s %s: no fixture matches\n", endpoint.Name, call)
+	return targetResult{err: &transportError{class: transportErrorDefault, err: errNoFixture}}, true
+}
+
+// fixtureResult turns a fixture into the result of a target call. Text bodies are used as
+// they are, other bodies are encoded as JSON. The Content-Type header decides how the body
+// is read, as it does for a target response.
+func fixtureResult(fixture conf.Fixture, target conf.APITarget) targetResult {
+	result := targetResult{status: fixture.Status}
+	if result.status == 0 {
+		result.status = http.StatusOK
+	}
+
+	var body []byte
+	switch b := fixture.Body.(type) {
+	case nil:
+		if fixture.BodyFile != "" {
+			data, err := os.ReadFile(fixture.BodyFile)
+			if err != nil {
+				return targetResult{err: &transportError{class: transportErrorDefault, err: err}}
+			}
+			body = data
+		}
+	case string:
+		body = []byte(b)
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			return targetResult{err: &transportError{class: transportErrorParse, err: err}}
+		}
+		body = data
+	}
+
+	headers := http.Header{}
+	for name, value := range fixture.Headers {
+		headers.Set(name, value)
+	}
+	var err error
+	result.bodyRaw = string(body)
+	result.bodyJSON, err = parseResponseBody(headers.Get("Content-Type"), body)
+	if err != nil {
+		result.parseErr = &transportError{class: transportErrorParse, err: err}
+		return result
+	}
+	if target.BodyFormat == bodyFormatSOAP {
+		result.bodyJSON = unwrapSOAPBody(result.bodyJSON)
+	}
+	return result
+}
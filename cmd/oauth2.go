@@ -0,0 +1,255 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// transportErrorAuth is the failure class of a target call that could not get an access token.
+const transportErrorAuth = "auth"
+
+// OAuth2 token settings.
+const (
+	defaultTokenRefreshBefore = 30 * time.Second
+	defaultTokenLifetime      = 5 * time.Minute
+	tokenRequestTimeout       = 10 * time.Second
+	authStyleBody             = "body"
+)
+
+// tokenSource fetches and caches the access token of one client. One call at a time fetches
+// a token, and concurrent calls wait for it, each only as long as its own context allows.
+type tokenSource struct {
+	mu       sync.Mutex
+	settings conf.OAuth2ClientCredentials
+	client   *http.Client
+	token    string
+	expires  time.Time
+	// refresh is closed when the fetch in flight ends, nil when none is.
+	refresh chan struct{}
+	// refreshErr is the error of the last fetch, returned to the calls that waited for it.
+	refreshErr error
+}
+
+// tokenSourceKey identifies the token source of a target.
+type tokenSourceKey struct {
+	tokenURL string
+	clientID string
+	scopes   string
+	tls      *conf.TLSSettings
+}
+
+// Token sources, shared by targets with the same token endpoint, client, scopes and TLS settings.
+var (
+	tokenSourcesMu sync.Mutex
+	tokenSources   = make(map[tokenSourceKey]*tokenSource)
+)
+
+// targetTokenSource returns the token source of a target, or nil when it has no OAuth2 auth.
+func targetTokenSource(target conf.APITarget) (*tokenSource, error) {
+	if target.Auth == nil || target.Auth.OAuth2 == nil {
+		return nil, nil
+	}
+	settings := target.Auth.OAuth2
+	key := tokenSourceKey{
+		tokenURL: settings.TokenURL,
+		clientID: settings.ClientID,
+		scopes:   strings.Join(settings.Scopes, " "),
+		tls:      target.TLS,
+	}
+
+	tokenSourcesMu.Lock()
+	defer tokenSourcesMu.Unlock()
+	if source, ok := tokenSources[key]; ok {
+		return source, nil
+	}
+	client, err := newTokenClient(target)
+	if err != nil {
+		return nil, &transportError{class: transportErrorAuth, err: err}
+	}
+	source := &tokenSource{settings: *settings, client: client}
+	tokenSources[key] = source
+	return source, nil
+}
+
+// newTokenClient returns a client for the token endpoint of a target, with the target's
+// connection settings and TLS client certificate, CA bundle and minimum version. The server
+// name and pinned keys name the target itself, so they are not applied to the token endpoint.
+func newTokenClient(target conf.APITarget) (*http.Client, error) {
+	transport := newTargetTransport(effectiveTimeouts(target), effectiveTransport(target))
+	if target.TLS != nil {
+		settings := *target.TLS
+		settings.ServerName = ""
+		settings.PinnedSHA256 = nil
+		tlsConfig, err := newTargetTLSConfig(&settings)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	return &http.Client{Timeout: tokenRequestTimeout, Transport: transport}, nil
+}
+
+// get returns a cached token, fetching a new one when it expires soon. A call that waits for
+// another call's fetch gives up when its context ends.
+func (s *tokenSource) get(ctx context.Context) (string, error) {
+	refreshBefore := s.settings.RefreshBefore.Duration()
+	if refreshBefore <= 0 {
+		refreshBefore = defaultTokenRefreshBefore
+	}
+
+	s.mu.Lock()
+	for {
+		if s.token != "" && time.Now().Add(refreshBefore).Before(s.expires) {
+			token := s.token
+			s.mu.Unlock()
+			return token, nil
+		}
+		if s.refresh == nil {
+			break
+		}
+		refresh := s.refresh
+		s.mu.Unlock()
+		select {
+		case <-refresh:
+		case <-ctx.Done():
+			return "", &transportError{class: transportErrorAuth, err: ctx.Err()}
+		}
+		s.mu.Lock()
+		// A fetch that failed on its own caller's context says nothing about the endpoint,
+		// so the waiting call fetches instead.
+		if err := s.refreshErr; err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+			s.mu.Unlock()
+			return "", &transportError{class: transportErrorAuth, err: err}
+		}
+	}
+	refresh := make(chan struct{})
+	s.refresh = refresh
+	s.mu.Unlock()
+
+	token, expiresIn, err := s.fetch(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refresh = nil
+	s.refreshErr = err
+	close(refresh)
+	if err != nil {
+		return "", &transportError{class: transportErrorAuth, err: err}
+	}
+	s.token = token
+	s.expires = time.Now().Add(expiresIn)
+	fmt.Printf("OAUTH2 TOKEN fetched from %s, expires in %s\n", s.settings.TokenURL, expiresIn)
+	return s.token, nil
+}
+
+// invalidate forgets a token the target rejected, unless it has been replaced already.
+func (s *tokenSource) invalidate(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token == token {
+		s.token = ""
+	}
+}
+
+// tokenResponse is the token endpoint's answer.
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// fetch requests a token with the client credentials grant, bound to ctx.
+func (s *tokenSource) fetch(ctx context.Context) (string, time.Duration, error) {
+	clientID, err := resolveSecret(s.settings.ClientID)
+	if err != nil {
+		return "", 0, err
+	}
+	clientSecret, err := resolveSecret(s.settings.ClientSecret)
+	if err != nil {
+		return "", 0, err
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(s.settings.Scopes) > 0 {
+		form.Set("scope", strings.Join(s.settings.Scopes, " "))
+	}
+	if s.settings.AuthStyle == authStyleBody {
+		form.Set("client_id", clientID)
+		form.Set("client_secret", clientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.settings.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if s.settings.AuthStyle != authStyleBody {
+		req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("token endpoint returned %d: %s", resp.StatusCode, body)
+	}
+
+	var token tokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", 0, err
+	}
+	if token.AccessToken == "" {
+		return "", 0, errors.New("token endpoint returned no access_token")
+	}
+	if token.ExpiresIn <= 0 {
+		return token.AccessToken, defaultTokenLifetime, nil
+	}
+	return token.AccessToken, time.Duration(token.ExpiresIn) * time.Second, nil
+}
+
+// resolveSecret returns a configured secret, read from the environment with "src:env|NAME"
+// or from a file with "src:file|path", or as written. An unset variable, an unreadable file
+// or an empty value is an error.
+func resolveSecret(value string) (string, error) {
+	if !strings.HasPrefix(value, "src:env|") && !strings.HasPrefix(value, "src:file|") {
+		return value, nil
+	}
+	secret := handleStringDataMapping(value, nil, nil)
+	if secret == nil || secret == "" {
+		return "", fmt.Errorf("secret %s has no value", value)
+	}
+	return fmt.Sprint(secret), nil
+}
+
+// getEnvValue returns the value of an environment variable.
+func getEnvValue(name string) interface{} {
+	return os.Getenv(name)
+}
+
+// getFileValue returns the contents of a file without surrounding white space.
+func getFileValue(path string) interface{} {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Printf("Failed to read %s: %v\n", path, err)
+		return nil
+	}
+	return strings.TrimSpace(string(data))
+}
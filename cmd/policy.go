@@ -0,0 +1,67 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"expvar"
+	"fmt"
+	"net/http"
+)
+
+// Policy effects.
+const (
+	policyAllow = "allow"
+	policyDeny  = "deny"
+)
+
+// policyDenialsMetric counts requests denied by a policy, keyed by API mapping name.
+var policyDenialsMetric = expvar.NewMap("policy_denials")
+
+// authorize applies the policy of an API mapping. The first rule whose condition holds
+// decides; without one the policy's default applies, allow unless it is set to deny. A rule
+// that cannot be evaluated denies. Denied requests get the policy's response and false is
+// returned.
+func authorize(w http.ResponseWriter, r *http.Request, endpoint conf.APIEndpoint) bool {
+	policy := endpoint.Policy
+	if policy == nil {
+		return true
+	}
+
+	effect, rule := policy.Default, "default"
+	for _, candidate := range policy.Rules {
+		holds, err := conditionHolds(candidate.When, r)
+		if err != nil {
+			fmt.Printf("POLICY rule %s cannot be evaluated: %v\n", candidate.Name, err)
+			effect, rule = policyDeny, candidate.Name
+			break
+		}
+		if holds {
+			effect, rule = candidate.Effect, candidate.Name
+			break
+		}
+	}
+	if effect != policyDeny {
+		return true
+	}
+
+	fmt.Printf("POLICY DENIED by rule %s\n", rule)
+	policyDenialsMetric.Add(endpoint.Name, 1)
+	writeForbiddenResponse(w, r, policy.Response)
+	return false
+}
+
+// validatePolicy checks the effects and conditions of a policy when the configuration is
+// loaded, so a mistyped policy cannot silently allow requests.
+func validatePolicy(policy *conf.Policy) error {
+	if policy.Default != "" && policy.Default != policyAllow && policy.Default != policyDeny {
+		return fmt.Errorf("policy default must be %q or %q, not %q", policyAllow, policyDeny, policy.Default)
+	}
+	for _, rule := range policy.Rules {
+		if rule.Effect != policyAllow && rule.Effect != policyDeny {
+			return fmt.Errorf("policy rule %s: effect must be %q or %q, not %q", rule.Name, policyAllow, policyDeny, rule.Effect)
+		}
+		if err := validateCondition(rule.When); err != nil {
+			return fmt.Errorf("policy rule %s: %w", rule.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"container/list"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Rate limit and quota settings.
+const (
+	defaultQuotaFile     = "quotas.json"
+	quotaFlushInterval   = time.Second
+	quotaPeriodDaily     = "daily"
+	quotaPeriodMonthly   = "monthly"
+	quotaDailyLayout     = "2006-01-02"
+	quotaMonthlyLayout   = "2006-01"
+	rateLimitReasonRate  = "rate"
+	rateLimitReasonQuota = "quota"
+	defaultMaxConsumers  = 10000
+	bucketIdleTimeout    = time.Hour
+)
+
+// quotaPeriodLayouts names the period of each quota period type.
+var quotaPeriodLayouts = map[string]string{
+	quotaPeriodDaily:   quotaDailyLayout,
+	quotaPeriodMonthly: quotaMonthlyLayout,
+}
+
+// rateLimitedMetric counts rejected requests, keyed by API mapping name.
+var rateLimitedMetric = expvar.NewMap("rate_limited")
+
+// tokenBucket allows a steady rate of requests with bursts up to its capacity.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// quotaCounter counts the requests of a consumer in the current period, such as "2024-05".
+type quotaCounter struct {
+	Period string `json:"period"`
+	Count  int64  `json:"count"`
+}
+
+// rateLimiter keeps the token buckets and quota counters of every API mapping. Quota
+// counters are written to the quota file, so they survive restarts.
+type rateLimiter struct {
+	mu sync.Mutex
+	// buckets is keyed by API mapping name and consumer key.
+	buckets map[string]map[string]*tokenBucket
+	// quotas is keyed by API mapping name, consumer key and quota period type.
+	quotas map[string]map[string]map[string]*quotaCounter
+	// consumers orders the consumers of each API mapping by their last request.
+	consumers map[string]*consumerOrder
+	dirty     bool
+	path      string
+}
+
+// consumerOrder orders the consumers of an API mapping, most recently seen first.
+type consumerOrder struct {
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+var (
+	rateLimiterOnce sync.Once
+	limiter         *rateLimiter
+)
+
+// loadRateLimiter returns the rate limiter, loading stored quota counters on first use.
+func loadRateLimiter() *rateLimiter {
+	rateLimiterOnce.Do(func() {
+		path := config.QuotaFile
+		if path == "" {
+			path = defaultQuotaFile
+		}
+		limiter = &rateLimiter{
+			buckets:   make(map[string]map[string]*tokenBucket),
+			quotas:    make(map[string]map[string]map[string]*quotaCounter),
+			consumers: make(map[string]*consumerOrder),
+			path:      path,
+		}
+		if data, err := os.ReadFile(path); err == nil {
+			if err := json.Unmarshal(data, &limiter.quotas); err != nil {
+				fmt.Printf("Failed to read quota file %s: %v\n", path, err)
+			}
+		}
+		for name, consumers := range limiter.quotas {
+			for consumer := range consumers {
+				limiter.touch(name, consumer, math.MaxInt)
+			}
+		}
+		limiter.prune(time.Now())
+		go limiter.flushLoop()
+	})
+	return limiter
+}
+
+// allow decides whether a request of a consumer may go ahead. When it may not, it returns
+// the reason and how long the consumer should wait.
+func (l *rateLimiter) allow(endpoint conf.APIEndpoint, consumer string, now time.Time) (string, time.Duration) {
+	settings := endpoint.RateLimit
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	maxConsumers := settings.MaxConsumers
+	if maxConsumers <= 0 {
+		maxConsumers = defaultMaxConsumers
+	}
+	l.touch(endpoint.Name, consumer, maxConsumers)
+
+	// Check the quotas before taking a token, a request over quota costs nothing.
+	periods := quotaPeriods(settings.Quota, now)
+	counters := l.quotas[endpoint.Name][consumer]
+	for periodType, period := range periods {
+		counter := counters[periodType]
+		if counter != nil && counter.Period == period.name && counter.Count >= period.limit {
+			return rateLimitReasonQuota, period.end.Sub(now)
+		}
+	}
+
+	if settings.Rate > 0 {
+		burst := float64(settings.Burst)
+		if burst < 1 {
+			burst = math.Max(1, settings.Rate)
+		}
+		if l.buckets[endpoint.Name] == nil {
+			l.buckets[endpoint.Name] = make(map[string]*tokenBucket)
+		}
+		bucket, ok := l.buckets[endpoint.Name][consumer]
+		if !ok {
+			bucket = &tokenBucket{tokens: burst, updated: now}
+			l.buckets[endpoint.Name][consumer] = bucket
+		}
+		bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*settings.Rate)
+		bucket.updated = now
+		if bucket.tokens < 1 {
+			wait := time.Duration((1 - bucket.tokens) / settings.Rate * float64(time.Second))
+			return rateLimitReasonRate, wait
+		}
+		bucket.tokens--
+	}
+
+	for periodType, period := range periods {
+		if l.quotas[endpoint.Name] == nil {
+			l.quotas[endpoint.Name] = make(map[string]map[string]*quotaCounter)
+		}
+		if l.quotas[endpoint.Name][consumer] == nil {
+			l.quotas[endpoint.Name][consumer] = make(map[string]*quotaCounter)
+		}
+		counter := l.quotas[endpoint.Name][consumer][periodType]
+		if counter == nil || counter.Period != period.name {
+			counter = &quotaCounter{Period: period.name}
+			l.quotas[endpoint.Name][consumer][periodType] = counter
+		}
+		counter.Count++
+		l.dirty = true
+	}
+	return "", 0
+}
+
+// quotaPeriod is the current period of one quota.
+type quotaPeriod struct {
+	name  string
+	limit int64
+	end   time.Time
+}
+
+// quotaPeriods returns the current period of each configured quota, in UTC.
+func quotaPeriods(quota *conf.Quota, now time.Time) map[string]quotaPeriod {
+	periods := make(map[string]quotaPeriod)
+	if quota == nil {
+		return periods
+	}
+	now = now.UTC()
+	if quota.Daily > 0 {
+		start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		periods[quotaPeriodDaily] = quotaPeriod{
+			name:  now.Format(quotaDailyLayout),
+			limit: quota.Daily,
+			end:   start.AddDate(0, 0, 1),
+		}
+	}
+	if quota.Monthly > 0 {
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		periods[quotaPeriodMonthly] = quotaPeriod{
+			name:  now.Format(quotaMonthlyLayout),
+			limit: quota.Monthly,
+			end:   start.AddDate(0, 1, 0),
+		}
+	}
+	return periods
+}
+
+// touch marks a consumer of an API mapping as seen. When the API mapping tracks more than
+// maxConsumers, the least recently seen consumer is forgotten with its bucket and counters,
+// so new consumers are never turned away because the table is full.
+func (l *rateLimiter) touch(name, consumer string, maxConsumers int) {
+	consumers := l.consumers[name]
+	if consumers == nil {
+		consumers = &consumerOrder{order: list.New(), elements: make(map[string]*list.Element)}
+		l.consumers[name] = consumers
+	}
+	if element, ok := consumers.elements[consumer]; ok {
+		consumers.order.MoveToFront(element)
+		return
+	}
+	consumers.elements[consumer] = consumers.order.PushFront(consumer)
+
+	for consumers.order.Len() > maxConsumers {
+		oldest := consumers.order.Back()
+		evicted := consumers.order.Remove(oldest).(string)
+		delete(consumers.elements, evicted)
+		delete(l.buckets[name], evicted)
+		if _, ok := l.quotas[name][evicted]; ok {
+			delete(l.quotas[name], evicted)
+			l.dirty = true
+		}
+	}
+}
+
+// prune forgets token buckets that have been idle long enough to be full again and quota
+// counters of past periods, along with consumers left without any. The caller must hold
+// l.mu unless the limiter is not shared yet.
+func (l *rateLimiter) prune(now time.Time) {
+	for name, consumers := range l.buckets {
+		for consumer, bucket := range consumers {
+			if now.Sub(bucket.updated) > bucketIdleTimeout {
+				delete(consumers, consumer)
+			}
+		}
+		if len(consumers) == 0 {
+			delete(l.buckets, name)
+		}
+	}
+
+	for name, consumers := range l.quotas {
+		for consumer, counters := range consumers {
+			for periodType, counter := range counters {
+				layout, ok := quotaPeriodLayouts[periodType]
+				if !ok || counter.Period != now.UTC().Format(layout) {
+					delete(counters, periodType)
+					l.dirty = true
+				}
+			}
+			if len(counters) == 0 {
+				delete(consumers, consumer)
+			}
+		}
+		if len(consumers) == 0 {
+			delete(l.quotas, name)
+		}
+	}
+
+	for name, consumers := range l.consumers {
+		for consumer, element := range consumers.elements {
+			_, hasBucket := l.buckets[name][consumer]
+			_, hasQuota := l.quotas[name][consumer]
+			if !hasBucket && !hasQuota {
+				consumers.order.Remove(element)
+				delete(consumers.elements, consumer)
+			}
+		}
+		if len(consumers.elements) == 0 {
+			delete(l.consumers, name)
+		}
+	}
+}
+
+// flushLoop prunes the rate limiter and writes changed quota counters to the quota file.
+func (l *rateLimiter) flushLoop() {
+	for range time.Tick(quotaFlushInterval) {
+		l.mu.Lock()
+		l.prune(time.Now())
+		if !l.dirty {
+			l.mu.Unlock()
+			continue
+		}
+		data, err := json.MarshalIndent(l.quotas, "", "  ")
+		l.dirty = false
+		l.mu.Unlock()
+
+		if err == nil {
+			err = writeFileAtomic(l.path, data)
+		}
+		if err != nil {
+			fmt.Printf("Failed to write quota file %s: %v\n", l.path, err)
+		}
+	}
+}
+
+// writeFileAtomic replaces a file through a temporary file, so a crash never leaves it half written.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// checkRateLimit applies the rate limit and quotas of an API mapping. It sends the 429
+// response and returns false when the request may not go ahead.
+func checkRateLimit(w http.ResponseWriter, r *http.Request, endpoint conf.APIEndpoint) bool {
+	if endpoint.RateLimit == nil {
+		return true
+	}
+
+	consumer := rateLimitConsumer(r, endpoint)
+	reason, wait := loadRateLimiter().allow(endpoint, consumer, time.Now())
+	if reason == "" {
+		return true
+	}
+
+	fmt.Printf("RATE LIMITED (%s): %s\n", reason, consumer)
+	rateLimitedMetric.Add(endpoint.Name, 1)
+
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	if res := endpoint.RateLimit.Response; res != nil {
+		writeMappedResponse(w, r, *res)
+		return false
+	}
+	message := "Rate limit exceeded"
+	if reason == rateLimitReasonQuota {
+		message = "Quota exceeded"
+	}
+	writeJSONResponse(w, http.StatusTooManyRequests, map[string]interface{}{
+		"status":  http.StatusTooManyRequests,
+		"code":    "TOO_MANY_REQUESTS",
+		"message": message,
+	})
+	return false
+}
+
+// rateLimitConsumer returns the consumer key of a request. Requests whose key has no value
+// are told apart by their client IP instead, so they do not all share one bucket.
+func rateLimitConsumer(r *http.Request, endpoint conf.APIEndpoint) string {
+	value := mapData(endpoint.RateLimit.Key, r, r.Header)
+	if value == nil || value == "" {
+		return "ip:" + fmt.Sprint(getClientValue(r, "ip"))
+	}
+	return "key:" + fmt.Sprint(value)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// maxRequestBodySize is the largest inbound request body the gateway reads.
+const maxRequestBodySize = 32 << 20
+
+// maxMultipartMemory is the amount of an inbound multipart body kept in memory; larger
+// files are written to temporary files until the request is answered.
+const maxMultipartMemory = 10 << 20
+
+// errUnsupportedMediaType is returned when the inbound body has a Content-Type the gateway cannot parse.
+var errUnsupportedMediaType = errors.New("unsupported media type")
+
+// parseRequestBody turns the inbound request body into a queryable JSON tree based on its
+// Content-Type, so that src:req_body paths work for JSON, form, multipart and XML bodies.
+// Form and multipart fields are also kept for src:req_form.
+func parseRequestBody(r *http.Request, body []byte) (gjson.Result, error) {
+	if strings.TrimSpace(string(body)) == "" {
+		// Requests that only carry query parameters have nothing to parse.
+		return gjson.Result{}, nil
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		// Keep accepting JSON bodies sent without a Content-Type.
+		return gjson.Parse(string(body)), nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return gjson.Result{}, errUnsupportedMediaType
+	}
+
+	switch {
+	case isJSONMediaType(mediaType):
+		return gjson.Parse(string(body)), nil
+	case isXMLMediaType(mediaType):
+		tree, err := parseXML(body)
+		if err != nil {
+			return gjson.Result{}, err
+		}
+		return treeToJSON(tree)
+	case mediaType == "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return gjson.Result{}, err
+		}
+		getRequestContext(r).formValues = values
+		return treeToJSON(formToTree(values))
+	case mediaType == "multipart/form-data":
+		form, err := inboundMultipartForm(r)
+		if err != nil {
+			return gjson.Result{}, err
+		}
+		getRequestContext(r).formValues = form.Value
+		return treeToJSON(formToTree(form.Value))
+	default:
+		return gjson.Result{}, errUnsupportedMediaType
+	}
+}
+
+// formToTree converts form fields into a tree. Keys containing "." become nested objects
+// and repeated fields become arrays.
+func formToTree(values url.Values) map[string]interface{} {
+	tree := make(map[string]interface{})
+	for key, fieldValues := range values {
+		var value interface{} = fieldValues[0]
+		if len(fieldValues) > 1 {
+			items := make([]interface{}, len(fieldValues))
+			for i, fieldValue := range fieldValues {
+				items[i] = fieldValue
+			}
+			value = items
+		}
+
+		node := tree
+		parts := strings.Split(key, ".")
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := node[part].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				node[part] = child
+			}
+			node = child
+		}
+		node[parts[len(parts)-1]] = value
+	}
+	return tree
+}
+
+// treeToJSON converts a parsed tree into a gjson.Result.
+func treeToJSON(tree map[string]interface{}) (gjson.Result, error) {
+	treeJSON, err := json.Marshal(tree)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	return gjson.ParseBytes(treeJSON), nil
+}
+
+// getRequestFormValue retrieves a field of an inbound form or multipart request.
+func getRequestFormValue(rc *requestContext, key string) interface{} {
+	fieldValues, ok := rc.formValues[key]
+	if !ok || len(fieldValues) == 0 {
+		return nil
+	}
+	return fieldValues[0]
+}
+
+// writeUnsupportedMediaTypeResponse sends the response mapped for an inbound body that
+// cannot be parsed, or a plain 415 JSON body when none is configured.
+func writeUnsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request, endpoint conf.APIEndpoint) {
+	fmt.Println("Unsupported request Content-Type:", r.Header.Get("Content-Type"))
+	if res := endpoint.RequestMapping.OnUnsupportedMediaType; res != nil {
+		writeMappedResponse(w, r, *res)
+		return
+	}
+	writeJSONResponse(w, http.StatusUnsupportedMediaType, map[string]interface{}{
+		"status":  http.StatusUnsupportedMediaType,
+		"code":    "UNSUPPORTED_MEDIA_TYPE",
+		"message": "Unsupported Content-Type: " + r.Header.Get("Content-Type"),
+	})
+}
+
+// filePart is a file received in an inbound multipart request.
+type filePart struct {
+	FileName    string `json:"fileName"`
+	ContentType string `json:"contentType"`
+	Content     []byte `json:"content"`
+}
+
+// inboundMultipartForm parses the inbound multipart body once per request.
+func inboundMultipartForm(r *http.Request) (*multipart.Form, error) {
+	rc := getRequestContext(r)
+	if rc.multipartForm != nil {
+		return rc.multipartForm, nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, errors.New("request is not multipart")
+	}
+
+	reader := multipart.NewReader(bytes.NewReader(rc.bodyRaw), params["boundary"])
+	form, err := reader.ReadForm(maxMultipartMemory)
+	if err != nil {
+		return nil, err
+	}
+	rc.multipartForm = form
+	return form, nil
+}
+
+// removeMultipartFiles removes the temporary files of the inbound multipart body, if any.
+func (rc *requestContext) removeMultipartFiles() {
+	if rc.multipartForm == nil {
+		return
+	}
+	if err := rc.multipartForm.RemoveAll(); err != nil {
+		fmt.Println("Error removing multipart files:", err)
+	}
+}
+
+// getRequestFile retrieves a file part of the inbound multipart request.
+func getRequestFile(r *http.Request, field string) interface{} {
+	form, err := inboundMultipartForm(r)
+	if err != nil {
+		fmt.Printf("Error reading file %s: %v\n", field, err)
+		return nil
+	}
+
+	files := form.File[field]
+	if len(files) == 0 {
+		return nil
+	}
+
+	file, err := files[0].Open()
+	if err != nil {
+		fmt.Printf("Error opening file %s: %v\n", field, err)
+		return nil
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		fmt.Printf("Error reading file %s: %v\n", field, err)
+		return nil
+	}
+
+	return filePart{
+		FileName:    files[0].Filename,
+		ContentType: files[0].Header.Get("Content-Type"),
+		Content:     content,
+	}
+}
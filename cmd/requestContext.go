@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+
+	"github.com/tidwall/gjson"
+)
+
+// requestContext is the data of one inbound request that the mappings read: its parsed
+// body, the claims of its caller, the target response being mapped and the results of
+// its steps and branches.
+// Each request carries its own in its context.
+type requestContext struct {
+	bodyJSON         gjson.Result
+	bodyRaw          []byte
+	multipartForm    *multipart.Form
+	formValues       url.Values
+	responseJSON     gjson.Result
+	responseRaw      string
+	responseParseErr error
+	targetResults    map[string]targetResult
+	omittedBranches  map[string]bool
+	authClaims       gjson.Result
+}
+
+// newRequestContext returns empty request data.
+func newRequestContext() *requestContext {
+	return &requestContext{
+		targetResults:   make(map[string]targetResult),
+		omittedBranches: make(map[string]bool),
+	}
+}
+
+// requestContextKey is the context key of the request data.
+type requestContextKey struct{}
+
+// withRequestContext returns the request carrying new, empty request data.
+func withRequestContext(r *http.Request) (*http.Request, *requestContext) {
+	rc := newRequestContext()
+	return r.WithContext(context.WithValue(r.Context(), requestContextKey{}, rc)), rc
+}
+
+// getRequestContext returns the data of a request. Requests that do not carry any, such as
+// the nil request used to resolve secrets, get empty data.
+func getRequestContext(r *http.Request) *requestContext {
+	if r != nil {
+		if rc, ok := r.Context().Value(requestContextKey{}).(*requestContext); ok {
+			return rc
+		}
+	}
+	return newRequestContext()
+}
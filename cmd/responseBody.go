@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// errUnparseableResponse is returned when the target response body cannot be mapped.
+var errUnparseableResponse = errors.New("unparseable target response")
+
+// parseResponseBody turns the target response body into a queryable JSON tree based on
+// its Content-Type. Empty and plain text bodies give an empty tree; their raw text is
+// still available through src:res_raw.
+func parseResponseBody(contentType string, body []byte) (gjson.Result, error) {
+	if strings.TrimSpace(string(body)) == "" {
+		return gjson.Result{}, nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = ""
+	}
+
+	switch {
+	case isJSONMediaType(mediaType):
+		return parseJSONBody(body)
+	case isXMLMediaType(mediaType):
+		return parseXMLBody(body)
+	case mediaType == "text/plain":
+		// Some targets send JSON as text/plain, other text is only available raw.
+		if gjson.Valid(string(body)) {
+			return gjson.Parse(string(body)), nil
+		}
+		return gjson.Result{}, nil
+	case mediaType == "text/html":
+		return gjson.Result{}, errUnparseableResponse
+	default:
+		// Unknown or missing Content-Type, try JSON first and then XML.
+		if gjson.Valid(string(body)) {
+			return gjson.Parse(string(body)), nil
+		}
+		if strings.HasPrefix(strings.TrimSpace(string(body)), "<") {
+			return parseXMLBody(body)
+		}
+		return gjson.Result{}, errUnparseableResponse
+	}
+}
+
+// parseJSONBody parses a JSON body.
+func parseJSONBody(body []byte) (gjson.Result, error) {
+	if !gjson.Valid(string(body)) {
+		return gjson.Result{}, errUnparseableResponse
+	}
+	return gjson.Parse(string(body)), nil
+}
+
+// parseXMLBody parses an XML body into the same tree shape as a JSON body.
+func parseXMLBody(body []byte) (gjson.Result, error) {
+	tree, err := parseXML(body)
+	if err != nil {
+		return gjson.Result{}, errUnparseableResponse
+	}
+	result, err := treeToJSON(tree)
+	if err != nil {
+		return gjson.Result{}, errUnparseableResponse
+	}
+	return result, nil
+}
+
+// isJSONMediaType reports whether the media type is JSON, including "+json" suffixes.
+func isJSONMediaType(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// isXMLMediaType reports whether the media type is XML, including "+xml" suffixes.
+func isXMLMediaType(mediaType string) bool {
+	return mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml")
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"container/list"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache defaults.
+const (
+	defaultCacheTTL        = time.Minute
+	defaultCacheMaxEntries = 1000
+)
+
+// Cache metrics, keyed by API mapping name.
+var (
+	cacheHitsMetric   = expvar.NewMap("cache_hits")
+	cacheMissesMetric = expvar.NewMap("cache_misses")
+	cacheStaleMetric  = expvar.NewMap("cache_stale")
+)
+
+// cachedResponse is a mapped response kept in the cache.
+type cachedResponse struct {
+	key          string
+	httpResponse int
+	response     interface{}
+	expires      time.Time
+}
+
+// responseCache is a size-bounded, least recently used cache of mapped responses.
+type responseCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	order      *list.List
+}
+
+// Response caches by API mapping name.
+var (
+	responseCachesMu sync.Mutex
+	responseCaches   = make(map[string]*responseCache)
+)
+
+// endpointCache returns the response cache of an API mapping, or nil when caching is off.
+func endpointCache(endpoint conf.APIEndpoint) *responseCache {
+	if endpoint.Cache == nil {
+		return nil
+	}
+
+	responseCachesMu.Lock()
+	defer responseCachesMu.Unlock()
+	if cache, ok := responseCaches[endpoint.Name]; ok {
+		return cache
+	}
+
+	maxEntries := endpoint.Cache.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheMaxEntries
+	}
+	cache := &responseCache{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+	responseCaches[endpoint.Name] = cache
+	return cache
+}
+
+// cacheKey builds the cache key of a request from the configured src: expressions. When the
+// API mapping authenticates its callers, the caller's subject is part of the key, so one
+// caller is never answered with a response mapped for another.
+func cacheKey(endpoint conf.APIEndpoint, r *http.Request) string {
+	parts := make([]string, len(endpoint.Cache.Key))
+	for i, expression := range endpoint.Cache.Key {
+		parts[i] = fmt.Sprint(mapData(expression, r, r.Header))
+	}
+	if endpoint.Auth != nil {
+		parts = append(parts, "sub="+getRequestContext(r).authClaims.Get("sub").String())
+	}
+	return strings.Join(parts, "|")
+}
+
+// validateCache rejects a cache without key expressions, whose single entry every caller
+// would share.
+func validateCache(cache *conf.ResponseCache) error {
+	if len(cache.Key) == 0 {
+		return fmt.Errorf("cache needs at least one key expression")
+	}
+	for _, expression := range cache.Key {
+		if expression == "" {
+			return fmt.Errorf("cache key expressions cannot be empty")
+		}
+	}
+	return nil
+}
+
+// get returns the entry for a key, fresh or stale.
+func (c *responseCache) get(key string) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*cachedResponse), true
+}
+
+// set stores an entry, evicting the least recently used one when the cache is full.
+func (c *responseCache) set(entry *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[entry.key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	if c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedResponse).key)
+	}
+}
+
+// serveCachedResponse answers from the cache when a fresh entry exists.
+func serveCachedResponse(w http.ResponseWriter, endpoint conf.APIEndpoint, cache *responseCache, key string) bool {
+	entry, ok := cache.get(key)
+	if !ok || time.Now().After(entry.expires) {
+		fmt.Println("CACHE MISS:", key)
+		cacheMissesMetric.Add(endpoint.Name, 1)
+		return false
+	}
+	fmt.Println("CACHE HIT:", key)
+	cacheHitsMetric.Add(endpoint.Name, 1)
+	writeJSONResponse(w, entry.httpResponse, entry.response)
+	return true
+}
+
+// serveStaleResponse answers with an expired entry while the target is failing, when
+// the cache allows it.
+func serveStaleResponse(w http.ResponseWriter, endpoint conf.APIEndpoint, cache *responseCache, key string) bool {
+	if cache == nil || !endpoint.Cache.StaleIfError {
+		return false
+	}
+	entry, ok := cache.get(key)
+	if !ok {
+		return false
+	}
+	fmt.Println("CACHE STALE:", key)
+	cacheStaleMetric.Add(endpoint.Name, 1)
+	writeJSONResponse(w, entry.httpResponse, entry.response)
+	return true
+}
+
+// storeCachedResponse caches a successful mapped response.
+func storeCachedResponse(endpoint conf.APIEndpoint, cache *responseCache, key string, httpResponse int, response interface{}) {
+	if cache == nil || httpResponse < 200 || httpResponse >= 300 {
+		return
+	}
+	ttl := endpoint.Cache.TTL.Duration()
+	if ttl <= 0 {
+		ttl = defaultCacheTTL
+	}
+	cache.set(&cachedResponse{
+		key:          key,
+		httpResponse: httpResponse,
+		response:     response,
+		expires:      time.Now().Add(ttl),
+	})
+}
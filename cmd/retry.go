@@ -0,0 +1,107 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// Backoff used when the retry policy does not set one.
+const (
+	defaultInitialBackoff = 100 * time.Millisecond
+	defaultMaxBackoff     = 5 * time.Second
+	defaultMultiplier     = 2
+)
+
+// retryAttempts returns how many times the target may be called for one request.
+// Non-idempotent methods are only retried when the policy explicitly allows it.
+func retryAttempts(target conf.APITarget) int {
+	policy := target.Retry
+	if policy == nil || policy.MaxAttempts <= 1 {
+		return 1
+	}
+	if !isIdempotentMethod(target.Method) && !policy.RetryNonIdempotent {
+		return 1
+	}
+	return policy.MaxAttempts
+}
+
+// isIdempotentMethod reports whether repeating a request with this method is safe.
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// shouldRetry reports whether the outcome of a target call is retryable under the policy.
+func shouldRetry(policy *conf.RetryPolicy, code int, err error, body gjson.Result) bool {
+	if policy == nil {
+		return false
+	}
+
+	if err != nil {
+		var tErr *transportError
+		if !errors.As(err, &tErr) {
+			return false
+		}
+		for _, class := range policy.RetryOnTransportErrors {
+			if class == tErr.class {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, status := range policy.RetryOnStatus {
+		if status == code {
+			return true
+		}
+	}
+
+	// Body codes such as a "status_code" of "10001" are compared as text.
+	for key, values := range policy.RetryOnBody {
+		responseValue := body.Get(key)
+		if !responseValue.Exists() {
+			continue
+		}
+		for _, value := range values {
+			if fmt.Sprint(value) == responseValue.String() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// retryBackoff returns the wait before the next attempt: exponential backoff capped at
+// the maximum, with half of it randomized so that clients do not retry in lockstep.
+func retryBackoff(policy *conf.RetryPolicy, attempt int) time.Duration {
+	initial := policy.InitialBackoff.Duration()
+	if initial <= 0 {
+		initial = defaultInitialBackoff
+	}
+	maxBackoff := policy.MaxBackoff.Duration()
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+	multiplier := policy.Multiplier
+	if multiplier < 1 {
+		multiplier = defaultMultiplier
+	}
+
+	backoff := time.Duration(float64(initial) * math.Pow(multiplier, float64(attempt-1)))
+	if backoff > maxBackoff || backoff <= 0 {
+		backoff = maxBackoff
+	}
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
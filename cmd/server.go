@@ -0,0 +1,148 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+)
+
+// Default listener addresses.
+const (
+	defaultHTTPAddr  = ":8082"
+	defaultHTTPSAddr = ":8443"
+)
+
+// Client certificate modes of the TLS listener.
+const (
+	clientAuthRequest = "request"
+	clientAuthRequire = "require"
+)
+
+// serve runs the gateway's listeners until one of them fails. Plain HTTP listens on the
+// configured address, or on :8082 when there is no TLS listener, so both may run side by side.
+// The metrics are only served on the admin address, when one is set.
+func serve(handler http.Handler, settings conf.ServerSettings) error {
+	errs := make(chan error, 3)
+	listeners := 0
+
+	if settings.TLS != nil {
+		server, err := newTLSServer(handler, settings.TLS)
+		if err != nil {
+			return err
+		}
+		listeners++
+		go func() {
+			fmt.Printf("Listening on %s (HTTPS)...\n", server.Addr)
+			errs <- server.ListenAndServeTLS("", "")
+		}()
+	}
+
+	if settings.Addr != "" || settings.TLS == nil {
+		addr := settings.Addr
+		if addr == "" {
+			addr = defaultHTTPAddr
+		}
+		listeners++
+		go func() {
+			fmt.Printf("Listening on %s...\n", addr)
+			errs <- http.ListenAndServe(addr, handler)
+		}()
+	}
+
+	// Metrics are served apart from the API mappings, on an address that can stay private.
+	if settings.AdminAddr != "" {
+		admin := http.NewServeMux()
+		admin.Handle(metricsPath, expvar.Handler())
+		listeners++
+		go func() {
+			fmt.Printf("Serving metrics on %s%s...\n", settings.AdminAddr, metricsPath)
+			errs <- http.ListenAndServe(settings.AdminAddr, admin)
+		}()
+	}
+
+	err := <-errs
+	if listeners > 1 {
+		fmt.Println("Stopping, a listener failed:", err)
+	}
+	return err
+}
+
+// newTLSServer builds the HTTPS listener. Its certificate and client CA bundle are read again
+// when the files change, and HTTP/2 is offered unless disabled.
+func newTLSServer(handler http.Handler, settings *conf.ServerTLS) (*http.Server, error) {
+	serverCert := newCertificateFiles(settings.CertFile, settings.KeyFile)
+	if _, err := serverCert.get(); err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return serverCert.get()
+		},
+	}
+	if settings.MinVersion != "" {
+		version, ok := tlsVersions[settings.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS version: %s", settings.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	// The CA bundle may be reloaded, so client certificates are verified in VerifyConnection.
+	switch settings.ClientAuth {
+	case "":
+	case clientAuthRequest, clientAuthRequire:
+		if settings.ClientCAFile == "" {
+			return nil, errors.New("clientAuth needs a clientCAFile")
+		}
+		caBundle := newCABundleFile(settings.ClientCAFile)
+		if _, err := caBundle.get(); err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientAuth = tls.RequestClientCert
+		if settings.ClientAuth == clientAuthRequire {
+			tlsConfig.ClientAuth = tls.RequireAnyClientCert
+		}
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return nil
+			}
+			return verifyClientChain(cs, caBundle)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported clientAuth: %s", settings.ClientAuth)
+	}
+
+	addr := settings.Addr
+	if addr == "" {
+		addr = defaultHTTPSAddr
+	}
+	server := &http.Server{Addr: addr, Handler: handler, TLSConfig: tlsConfig}
+	if settings.DisableHTTP2 {
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	return server, nil
+}
+
+// verifyClientChain verifies a client certificate chain against the CA bundle.
+func verifyClientChain(cs tls.ConnectionState, caBundle *caBundleFile) error {
+	roots, err := caBundle.get()
+	if err != nil {
+		return err
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err
+}
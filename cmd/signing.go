@@ -0,0 +1,202 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Signing algorithms.
+const (
+	signingHMACSHA256  = "hmac-sha256"
+	signingRSASHA256   = "rsa-sha256"
+	signingECDSASHA256 = "ecdsa-sha256"
+)
+
+// Signing header names and encodings.
+const (
+	defaultSignatureHeader = "X-Signature"
+	defaultTimestampHeader = "X-Timestamp"
+	defaultNonceHeader     = "X-Nonce"
+	signatureEncodingHex   = "hex"
+)
+
+// defaultSigningComponents is the canonical string used when none is configured.
+var defaultSigningComponents = []string{"method", "path", "timestamp", "nonce", "body-sha256"}
+
+// Parsed private keys are kept by their PEM text, so a key is only parsed again when it changes.
+var (
+	signingKeysMu sync.Mutex
+	signingKeys   = make(map[string]crypto.Signer)
+)
+
+// signTargetRequest adds the timestamp, nonce and signature headers to a target request.
+func signTargetRequest(req *http.Request, reqBody []byte, signing *conf.RequestSigning) error {
+	timestampHeader := signing.TimestampHeader
+	if timestampHeader == "" {
+		timestampHeader = defaultTimestampHeader
+	}
+	nonceHeader := signing.NonceHeader
+	if nonceHeader == "" {
+		nonceHeader = defaultNonceHeader
+	}
+	signatureHeader := signing.Header
+	if signatureHeader == "" {
+		signatureHeader = defaultSignatureHeader
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := uuid.New().String()
+	req.Header.Set(timestampHeader, timestamp)
+	req.Header.Set(nonceHeader, nonce)
+
+	canonical := canonicalString(req, reqBody, signing.Components, timestamp, nonce)
+	signature, err := sign(canonical, signing)
+	if err != nil {
+		return fmt.Errorf("signing request: %w", err)
+	}
+	if signing.Encoding == signatureEncodingHex {
+		req.Header.Set(signatureHeader, hex.EncodeToString(signature))
+	} else {
+		req.Header.Set(signatureHeader, base64.StdEncoding.EncodeToString(signature))
+	}
+	return nil
+}
+
+// canonicalString joins the signed components with new lines. Components are method, path
+// (with the query), timestamp, nonce, body-sha256 (hex) and header:<name>.
+func canonicalString(req *http.Request, reqBody []byte, components []string, timestamp, nonce string) string {
+	if len(components) == 0 {
+		components = defaultSigningComponents
+	}
+	values := make([]string, len(components))
+	for i, component := range components {
+		switch {
+		case component == "method":
+			values[i] = req.Method
+		case component == "path":
+			values[i] = req.URL.RequestURI()
+		case component == "timestamp":
+			values[i] = timestamp
+		case component == "nonce":
+			values[i] = nonce
+		case component == "body-sha256":
+			sum := sha256.Sum256(reqBody)
+			values[i] = hex.EncodeToString(sum[:])
+		case strings.HasPrefix(component, "header:"):
+			values[i] = req.Header.Get(strings.TrimPrefix(component, "header:"))
+		default:
+			fmt.Printf("Unsupported signing component: %s\n", component)
+		}
+	}
+	return strings.Join(values, "\n")
+}
+
+// validateSigning rejects an unknown algorithm, encoding or component, which would make the
+// target reject every request.
+func validateSigning(signing *conf.RequestSigning) error {
+	switch signing.Algorithm {
+	case "", signingHMACSHA256, signingRSASHA256, signingECDSASHA256:
+	default:
+		return fmt.Errorf("signing: unsupported algorithm %q", signing.Algorithm)
+	}
+	switch signing.Encoding {
+	case "", "base64", signatureEncodingHex:
+	default:
+		return fmt.Errorf("signing: unsupported encoding %q", signing.Encoding)
+	}
+	for _, component := range signing.Components {
+		switch component {
+		case "method", "path", "timestamp", "nonce", "body-sha256":
+			continue
+		}
+		if name, ok := strings.CutPrefix(component, "header:"); ok && name != "" {
+			continue
+		}
+		return fmt.Errorf("signing: unsupported component %q", component)
+	}
+	return nil
+}
+
+// sign signs the canonical string with the configured algorithm and key.
+func sign(canonical string, signing *conf.RequestSigning) ([]byte, error) {
+	key, err := resolveSecret(signing.Key)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return nil, errors.New("no signing key")
+	}
+
+	switch signing.Algorithm {
+	case signingHMACSHA256, "":
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(canonical))
+		return mac.Sum(nil), nil
+	case signingRSASHA256, signingECDSASHA256:
+		signer, err := parseSigningKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if _, isRSA := signer.(*rsa.PrivateKey); isRSA != (signing.Algorithm == signingRSASHA256) {
+			return nil, fmt.Errorf("signing key does not match algorithm %s", signing.Algorithm)
+		}
+		digest := sha256.Sum256([]byte(canonical))
+		return signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm: %s", signing.Algorithm)
+	}
+}
+
+// parseSigningKey parses a PEM RSA or ECDSA private key in PKCS#1, SEC 1 or PKCS#8 form.
+func parseSigningKey(keyPEM string) (crypto.Signer, error) {
+	signingKeysMu.Lock()
+	defer signingKeysMu.Unlock()
+	if signer, ok := signingKeys[keyPEM]; ok {
+		return signer, nil
+	}
+
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, errors.New("signing key is not PEM encoded")
+	}
+
+	var signer crypto.Signer
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		signer = key
+	} else if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		signer = key
+	} else {
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			signer = key
+		case *ecdsa.PrivateKey:
+			signer = key
+		default:
+			return nil, errors.New("signing key is neither RSA nor ECDSA")
+		}
+	}
+	signingKeys[keyPEM] = signer
+	return signer, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"net/http"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// SOAP envelope namespaces by SOAP version.
+const (
+	soap11Namespace = "http://schemas.xmlsoap.org/soap/envelope/"
+	soap12Namespace = "http://www.w3.org/2003/05/soap-envelope"
+)
+
+// encodeSOAPBody wraps the mapped request body in a SOAP envelope and returns the
+// Content-Type and SOAPAction headers that belong to the SOAP version.
+func encodeSOAPBody(envelope conf.SOAPEnvelope, reqBody interface{}, order map[string][]string, r *http.Request) ([]byte, http.Header) {
+	headers := make(http.Header)
+	namespace := soap11Namespace
+	if envelope.Version == "1.2" {
+		namespace = soap12Namespace
+		contentType := "application/soap+xml; charset=utf-8"
+		if envelope.Action != "" {
+			contentType += `; action="` + envelope.Action + `"`
+		}
+		headers.Set("Content-Type", contentType)
+	} else {
+		headers.Set("Content-Type", "text/xml; charset=utf-8")
+		headers.Set("SOAPAction", `"`+envelope.Action+`"`)
+	}
+
+	namespaces := map[string]string{"soap": namespace}
+	for prefix, uri := range envelope.Namespaces {
+		namespaces[prefix] = uri
+	}
+
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>`)
+	b.WriteString("<soap:Envelope")
+	writeXMLNamespaces(&b, namespaces)
+	b.WriteString(">")
+
+	// Map the SOAP header entries, if any.
+	if len(envelope.Header) > 0 {
+		b.WriteString("<soap:Header>")
+		header := mapData(envelope.Header, r, r.Header)
+		if entries, ok := header.(map[string]interface{}); ok {
+			for _, key := range orderedKeys(entries, "", nil) {
+				writeXMLElement(&b, key, entries[key], key, nil)
+			}
+		}
+		b.WriteString("</soap:Header>")
+	}
+
+	b.WriteString("<soap:Body>")
+	if entries, ok := reqBody.(map[string]interface{}); ok {
+		for _, key := range orderedKeys(entries, "", order) {
+			writeXMLElement(&b, key, entries[key], key, order)
+		}
+	}
+	b.WriteString("</soap:Body>")
+	b.WriteString("</soap:Envelope>")
+
+	return []byte(b.String()), headers
+}
+
+// unwrapSOAPBody returns the content of the SOAP Body so that src:res_body paths start
+// at the response element, or at "Fault" when the target answered with a SOAP Fault.
+func unwrapSOAPBody(response gjson.Result) gjson.Result {
+	body := response.Get("Envelope.Body")
+	if !body.Exists() {
+		return response
+	}
+	return body
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// Prefixes of the sources that read the result of a step or a fan-out branch.
+const (
+	srcStepPrefix   = "src:step."
+	srcBranchPrefix = "src:branch."
+)
+
+// targetResult is the outcome of one target call made while handling a request.
+type targetResult struct {
+	status   int
+	err      error
+	bodyJSON gjson.Result
+	bodyRaw  string
+	// parseErr is set when a response arrived but its body could not be parsed.
+	parseErr error
+	// target is the target that was called, whose breaker and bulkhead responses apply.
+	target conf.APITarget
+}
+
+// isTargetResultSource reports whether a source reads a target result, such as
+// "src:step.lookup.res_body", and returns the result name and field.
+func isTargetResultSource(srcType string) (string, string, bool) {
+	if !strings.HasPrefix(srcType, srcStepPrefix) && !strings.HasPrefix(srcType, srcBranchPrefix) {
+		return "", "", false
+	}
+	name := strings.TrimPrefix(srcType, "src:")
+	dot := strings.LastIndex(name, ".")
+	return name[:dot], name[dot+1:], true
+}
+
+// getTargetResultValue maps a field of a target result: res_body, res_raw or status.
+func getTargetResultValue(rc *requestContext, name, field, key string) interface{} {
+	result, ok := rc.targetResults[name]
+	if !ok {
+		return nil
+	}
+	switch field {
+	case "res_body":
+		value := result.bodyJSON.Get(key)
+		if !value.Exists() {
+			return nil
+		}
+		return value.Value()
+	case "res_raw":
+		return result.bodyRaw
+	case "status":
+		return result.status
+	}
+	return nil
+}
+
+// isCallFailure reports whether a step or branch call failed: a transport error, or a status
+// listed in failureStatus, by default any status of 400 or above.
+func isCallFailure(failureStatus []int, result targetResult) bool {
+	if result.err != nil {
+		return true
+	}
+	if len(failureStatus) == 0 {
+		return result.status >= 400
+	}
+	for _, status := range failureStatus {
+		if status == result.status {
+			return true
+		}
+	}
+	return false
+}
+
+// runSteps calls the steps of an API mapping in order, skipping those whose condition does
+// not hold. It returns the result of the last step called and whether the chain stopped on a
+// failed step. When the response has already been sent, handled is true.
+func runSteps(w http.ResponseWriter, r *http.Request, endpoint conf.APIEndpoint) (last *targetResult, stopped bool, handled bool) {
+	for _, step := range endpoint.Steps {
+		if step.When != nil && !evaluateCondition(*step.When, r) {
+			fmt.Println("STEP SKIPPED:", step.Name)
+			continue
+		}
+		fmt.Println("STEP:", step.Name)
+
+		reqBody := mapData(step.RequestMapping.RequestBody, r, r.Header)
+		requestBody, bodyHeaders, err := encodeTargetBody(step.Target, reqBody, step.RequestMapping.RequestBodyOrder, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return nil, true, true
+		}
+
+		result, mocked := mockTargetResult(endpoint, "step."+step.Name, step.Target, r)
+		if !mocked {
+			result = callTarget(step.Target, requestBody, targetHeaders(step.Target, bodyHeaders, r), r)
+		}
+		result.target = step.Target
+		getRequestContext(r).targetResults["step."+step.Name] = result
+		last = &result
+		if step.ContinueOnFailure || !isCallFailure(step.FailureStatus, result) {
+			continue
+		}
+
+		// Short-circuit: the remaining steps and the target are not called.
+		fmt.Println("STEP FAILED:", step.Name)
+		if step.OnFailure != nil {
+			writeMappedResponse(w, r, *step.OnFailure)
+			return last, true, true
+		}
+		if result.err != nil {
+			writeTransportErrorResponse(w, r, endpoint, step.Target, result.err)
+			return last, true, true
+		}
+		return last, true, false
+	}
+	return last, false, false
+}
+
+// useTargetResult makes a target result the response that the response mapping of a
+// request reads.
+func useTargetResult(r *http.Request, result *targetResult) (int, error) {
+	rc := getRequestContext(r)
+	if result == nil {
+		rc.responseJSON = gjson.Result{}
+		rc.responseRaw = ""
+		rc.responseParseErr = nil
+		return 0, nil
+	}
+	rc.responseJSON = result.bodyJSON
+	rc.responseRaw = result.bodyRaw
+	rc.responseParseErr = result.parseErr
+	return result.status, result.err
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Body formats supported for the request sent to the target API.
+const (
+	bodyFormatJSON      = "json"
+	bodyFormatXML       = "xml"
+	bodyFormatSOAP      = "soap"
+	bodyFormatForm      = "form"
+	bodyFormatMultipart = "multipart"
+)
+
+// encodeTargetBody serializes the mapped request body in the target's body format and
+// returns the headers that describe it.
+func encodeTargetBody(target conf.APITarget, reqBody interface{}, order map[string][]string, r *http.Request) ([]byte, http.Header, error) {
+	switch target.BodyFormat {
+	case "", bodyFormatJSON:
+		requestBody, err := json.Marshal(reqBody)
+		headers := make(http.Header)
+		headers.Set("Content-Type", "application/json")
+		return requestBody, headers, err
+	case bodyFormatXML:
+		return encodeXMLBody(target.XML, reqBody, order)
+	case bodyFormatSOAP:
+		var envelope conf.SOAPEnvelope
+		if target.SOAP != nil {
+			envelope = *target.SOAP
+		}
+		requestBody, headers := encodeSOAPBody(envelope, reqBody, order, r)
+		return requestBody, headers, nil
+	case bodyFormatForm:
+		return encodeFormBody(reqBody, order)
+	case bodyFormatMultipart:
+		return encodeMultipartBody(reqBody, order)
+	default:
+		return nil, nil, errors.New("unsupported target body format: " + target.BodyFormat)
+	}
+}
+
+// encodeXMLBody renders the mapped request body as an XML document.
+func encodeXMLBody(xmlBody *conf.XMLBody, reqBody interface{}, order map[string][]string) ([]byte, http.Header, error) {
+	entries, _ := reqBody.(map[string]interface{})
+	var settings conf.XMLBody
+	if xmlBody != nil {
+		settings = *xmlBody
+	}
+
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>`)
+	if settings.RootElement != "" {
+		// Wrap the mapped fields in the configured root element.
+		b.WriteString("<" + settings.RootElement)
+		writeXMLNamespaces(&b, settings.Namespaces)
+		b.WriteString(">")
+		for _, key := range orderedKeys(entries, "", order) {
+			writeXMLElement(&b, key, entries[key], key, order)
+		}
+		b.WriteString("</" + settings.RootElement + ">")
+	} else if len(entries) == 1 {
+		// The single top-level key is the root element.
+		for key, value := range entries {
+			writeXMLElement(&b, key, withNamespaces(value, settings.Namespaces), key, order)
+		}
+	} else {
+		return nil, nil, errors.New("XML target body needs a rootElement or a single top-level key")
+	}
+
+	headers := make(http.Header)
+	headers.Set("Content-Type", "application/xml; charset=utf-8")
+	return []byte(b.String()), headers, nil
+}
+
+// withNamespaces adds namespace declarations as attributes of a mapped element.
+func withNamespaces(value interface{}, namespaces map[string]string) interface{} {
+	if len(namespaces) == 0 {
+		return value
+	}
+	element, ok := value.(map[string]interface{})
+	if !ok {
+		element = map[string]interface{}{"#text": value}
+	}
+	for prefix, uri := range namespaces {
+		if prefix == "" {
+			element["@xmlns"] = uri
+		} else {
+			element["@xmlns:"+prefix] = uri
+		}
+	}
+	return element
+}
+
+// encodeFormBody serializes the mapped request body as URL-encoded form fields.
+func encodeFormBody(reqBody interface{}, order map[string][]string) ([]byte, http.Header, error) {
+	values := make(url.Values)
+	flattenFields(reqBody, order, func(key string, value interface{}) {
+		if file, ok := value.(filePart); ok {
+			values.Add(key, string(file.Content))
+			return
+		}
+		values.Add(key, xmlText(value))
+	})
+
+	headers := make(http.Header)
+	headers.Set("Content-Type", "application/x-www-form-urlencoded")
+	return []byte(values.Encode()), headers, nil
+}
+
+// encodeMultipartBody serializes the mapped request body as multipart/form-data parts.
+// Files mapped with src:req_file are sent as file parts.
+func encodeMultipartBody(reqBody interface{}, order map[string][]string) ([]byte, http.Header, error) {
+	var (
+		buf    bytes.Buffer
+		errOut error
+	)
+	writer := multipart.NewWriter(&buf)
+	flattenFields(reqBody, order, func(key string, value interface{}) {
+		if errOut != nil {
+			return
+		}
+		file, ok := value.(filePart)
+		if !ok {
+			errOut = writer.WriteField(key, xmlText(value))
+			return
+		}
+
+		partHeader := make(textproto.MIMEHeader)
+		partHeader.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, escapeQuotes(key), escapeQuotes(file.FileName)))
+		contentType := file.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		partHeader.Set("Content-Type", contentType)
+		part, err := writer.CreatePart(partHeader)
+		if err != nil {
+			errOut = err
+			return
+		}
+		_, errOut = part.Write(file.Content)
+	})
+	if errOut != nil {
+		return nil, nil, errOut
+	}
+	if err := writer.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	headers := make(http.Header)
+	headers.Set("Content-Type", writer.FormDataContentType())
+	return buf.Bytes(), headers, nil
+}
+
+// flattenFields walks the mapped request body and calls add for every scalar or file.
+// Nested keys are joined with "." and array items repeat the key of the array.
+func flattenFields(value interface{}, order map[string][]string, add func(key string, value interface{})) {
+	flattenField(value, "", "", order, add)
+}
+
+// flattenField flattens one value found under key, at path in the mapping template.
+func flattenField(value interface{}, key, path string, order map[string][]string, add func(key string, value interface{})) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, child := range orderedKeys(v, path, order) {
+			flattenField(v[child], conf.JoinPath(key, child), conf.JoinPath(path, child), order, add)
+		}
+	case []interface{}:
+		for i, item := range v {
+			flattenField(item, key, conf.JoinPath(path, strconv.Itoa(i)), order, add)
+		}
+	default:
+		add(key, v)
+	}
+}
+
+// escapeQuotes escapes a value for use in a quoted Content-Disposition parameter.
+func escapeQuotes(s string) string {
+	return strings.NewReplacer("\\", "\\\\", `"`, "\\\"").Replace(s)
+}
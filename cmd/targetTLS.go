@@ -0,0 +1,104 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// newTargetTLSConfig builds the TLS client configuration of a target: client certificate,
+// private CA bundle, SNI override, minimum version and certificate pinning. Certificate
+// and CA files are read again when they change.
+func newTargetTLSConfig(settings *conf.TLSSettings) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: settings.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if settings.MinVersion != "" {
+		version, ok := tlsVersions[settings.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS version: %s", settings.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	// Present the client certificate for mutual TLS.
+	if settings.CertFile != "" || settings.KeyFile != "" {
+		clientCert := newCertificateFiles(settings.CertFile, settings.KeyFile)
+		if _, err := clientCert.get(); err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return clientCert.get()
+		}
+	}
+
+	// Verify the server against the CA bundle, which may change at runtime, so the
+	// chain is checked in VerifyConnection instead of by the default verification.
+	var caBundle *caBundleFile
+	if settings.CAFile != "" {
+		caBundle = newCABundleFile(settings.CAFile)
+		if _, err := caBundle.get(); err != nil {
+			return nil, err
+		}
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	if caBundle != nil || len(settings.PinnedSHA256) > 0 {
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if caBundle != nil {
+				if err := verifyServerChain(cs, caBundle); err != nil {
+					return err
+				}
+			}
+			return verifyPinnedKey(cs, settings.PinnedSHA256)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// verifyServerChain verifies the server certificate chain and host name against the CA bundle.
+func verifyServerChain(cs tls.ConnectionState, caBundle *caBundleFile) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("tls: server sent no certificate")
+	}
+	roots, err := caBundle.get()
+	if err != nil {
+		return err
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// verifyPinnedKey checks that one certificate of the server chain has a pinned public key.
+// Pins are the base64 SHA-256 hash of the certificate's SubjectPublicKeyInfo.
+func verifyPinnedKey(cs tls.ConnectionState, pins []string) error {
+	if len(pins) == 0 {
+		return nil
+	}
+	for _, cert := range cs.PeerCertificates {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		pin := base64.StdEncoding.EncodeToString(sum[:])
+		for _, pinned := range pins {
+			if pin == pinned {
+				return nil
+			}
+		}
+	}
+	return errors.New("tls: no pinned public key in server certificate chain")
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// watchedFiles loads a set of files on first use and again whenever one of them
+// changes on disk, keeping the last good result when a reload fails.
+type watchedFiles struct {
+	mu       sync.Mutex
+	paths    []string
+	modTimes []time.Time
+	loaded   bool
+	value    interface{}
+	load     func() (interface{}, error)
+}
+
+// refresh reloads the files if any of them changed since the last load, and returns the
+// current result.
+func (f *watchedFiles) refresh() (interface{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	modTimes := make([]time.Time, len(f.paths))
+	changed := !f.loaded
+	for i, path := range f.paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			if f.loaded {
+				fmt.Printf("Keeping previous %s: %v\n", path, err)
+				return f.value, nil
+			}
+			return nil, err
+		}
+		modTimes[i] = info.ModTime()
+		if f.loaded && !modTimes[i].Equal(f.modTimes[i]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return f.value, nil
+	}
+
+	value, err := f.load()
+	if err != nil {
+		if f.loaded {
+			fmt.Printf("Keeping previous %v: %v\n", f.paths, err)
+			return f.value, nil
+		}
+		return nil, err
+	}
+	if f.loaded {
+		fmt.Printf("Reloaded %v\n", f.paths)
+	}
+	f.value = value
+	f.modTimes = modTimes
+	f.loaded = true
+	return value, nil
+}
+
+// certificateFiles is a certificate and private key pair that reloads when the files change.
+type certificateFiles struct {
+	files watchedFiles
+}
+
+// newCertificateFiles watches a PEM certificate and key file pair.
+func newCertificateFiles(certFile, keyFile string) *certificateFiles {
+	return &certificateFiles{files: watchedFiles{
+		paths: []string{certFile, keyFile},
+		load: func() (interface{}, error) {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, err
+			}
+			return &cert, nil
+		},
+	}}
+}
+
+// get returns the current certificate.
+func (c *certificateFiles) get() (*tls.Certificate, error) {
+	cert, err := c.files.refresh()
+	if err != nil {
+		return nil, err
+	}
+	return cert.(*tls.Certificate), nil
+}
+
+// caBundleFile is a PEM bundle of CA certificates that reloads when the file changes.
+type caBundleFile struct {
+	files watchedFiles
+}
+
+// newCABundleFile watches a PEM CA bundle.
+func newCABundleFile(path string) *caBundleFile {
+	return &caBundleFile{files: watchedFiles{
+		paths: []string{path},
+		load: func() (interface{}, error) {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, errors.New("no certificates found in " + path)
+			}
+			return pool, nil
+		},
+	}}
+}
+
+// get returns the current CA pool.
+func (c *caBundleFile) get() (*x509.CertPool, error) {
+	pool, err := c.files.refresh()
+	if err != nil {
+		return nil, err
+	}
+	return pool.(*x509.CertPool), nil
+}
+
+// tlsVersions maps configured TLS versions to their crypto/tls constants.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+)
+
+// Failure classes used as keys of the onTransportError response mapping.
+const (
+	transportErrorTimeout = "timeout"
+	transportErrorRefused = "refused"
+	transportErrorTLS     = "tls"
+	transportErrorDNS     = "dns"
+	transportErrorParse   = "parse"
+	transportErrorDefault = "default"
+)
+
+// transportError is a failure to get a usable response from the target API.
+type transportError struct {
+	class string
+	err   error
+}
+
+func (e *transportError) Error() string {
+	return e.err.Error()
+}
+
+func (e *transportError) Unwrap() error {
+	return e.err
+}
+
+// classifyTransportError determines the failure class of an error returned by the HTTP client.
+func classifyTransportError(err error) string {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return transportErrorDNS
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return transportErrorTimeout
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return transportErrorRefused
+	}
+
+	var (
+		recordErr    tls.RecordHeaderError
+		verifyErr    *tls.CertificateVerificationError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+	if errors.As(err, &recordErr) || errors.As(err, &verifyErr) || errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) || strings.Contains(err.Error(), "tls: ") {
+		return transportErrorTLS
+	}
+
+	return transportErrorDefault
+}
+
+// writeTransportErrorResponse sends the response mapped for a transport failure of a call to
+// target, the API mapping's own target or one of its steps or branches. When no
+// onTransportError entry matches, the default response of the endpoint is used.
+func writeTransportErrorResponse(w http.ResponseWriter, r *http.Request, endpoint conf.APIEndpoint, target conf.APITarget, err error) {
+	class := transportErrorDefault
+	var tErr *transportError
+	if errors.As(err, &tErr) {
+		class = tErr.class
+	}
+	fmt.Printf("TRANSPORT ERROR (%s): %v\n", class, err)
+
+	// A response that arrived but cannot be parsed has its own rule.
+	if errors.Is(err, errUnparseableResponse) && endpoint.ResponseMapping.OnUnparseableResponse != nil {
+		writeMappedResponse(w, r, *endpoint.ResponseMapping.OnUnparseableResponse)
+		return
+	}
+
+	// A target whose circuit is open answers with the breaker's own response.
+	breaker := target.CircuitBreaker
+	if class == transportErrorCircuitOpen && breaker != nil && breaker.Response != nil {
+		writeMappedResponse(w, r, *breaker.Response)
+		return
+	}
+
+	// A target without a free slot answers with the bulkhead's own response.
+	bulkhead := target.Bulkhead
+	if class == transportErrorBulkheadFull && bulkhead != nil && bulkhead.Response != nil {
+		writeMappedResponse(w, r, *bulkhead.Response)
+		return
+	}
+
+	onTransportError := endpoint.ResponseMapping.OnTransportError
+	if res, ok := onTransportError[class]; ok {
+		writeMappedResponse(w, r, res)
+		return
+	}
+	if res, ok := onTransportError[transportErrorDefault]; ok {
+		writeMappedResponse(w, r, res)
+		return
+	}
+	writeMappedResponse(w, r, defaultResponse(endpoint))
+}
+
+// defaultResponse returns the default response of the endpoint's response mapping type.
+func defaultResponse(endpoint conf.APIEndpoint) conf.Response {
+	if endpoint.ResponseMappingType == "byHTTPStatusCode" {
+		return endpoint.ResponseMapping.ByHTTPStatusCode.Default.Response
+	}
+	return endpoint.ResponseMapping.ByBodyResponse.Default.Response
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Load balancing strategies between upstream endpoints.
+const (
+	strategyRoundRobin       = "roundRobin"
+	strategyLeastConnections = "leastConnections"
+	strategyWeighted         = "weighted"
+)
+
+// Health check and outlier ejection defaults.
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+	defaultEjectionFailures    = 5
+	defaultEjectionDuration    = 30 * time.Second
+)
+
+// errNoUpstream is returned when every upstream endpoint of a target has been tried.
+var errNoUpstream = errors.New("no upstream endpoint available")
+
+// upstreamStateMetric publishes the state of each upstream endpoint.
+var upstreamStateMetric = expvar.NewMap("upstream_state")
+
+// upstreamEndpoint is one base URL of a target with its health.
+type upstreamEndpoint struct {
+	baseURL      *url.URL
+	weight       int
+	current      int
+	active       int
+	healthy      bool
+	failures     int
+	ejectedUntil time.Time
+}
+
+// upstreamPool chooses between the upstream endpoints of a target.
+type upstreamPool struct {
+	mu        sync.Mutex
+	client    *http.Client
+	settings  conf.Upstreams
+	endpoints []*upstreamEndpoint
+	next      int
+}
+
+// Upstream pools by target URL.
+var (
+	upstreamPoolsMu sync.Mutex
+	upstreamPools   = make(map[string]*upstreamPool)
+)
+
+// targetUpstreamPool returns the upstream pool of a target, or nil when it has a single URL.
+// Active health checks start with the pool.
+func targetUpstreamPool(target conf.APITarget, client *http.Client) (*upstreamPool, error) {
+	if target.Upstreams == nil || len(target.Upstreams.Endpoints) == 0 {
+		return nil, nil
+	}
+
+	upstreamPoolsMu.Lock()
+	defer upstreamPoolsMu.Unlock()
+	if pool, ok := upstreamPools[target.URL]; ok {
+		return pool, nil
+	}
+
+	pool := &upstreamPool{client: client, settings: *target.Upstreams}
+	for _, endpoint := range target.Upstreams.Endpoints {
+		baseURL, err := url.Parse(endpoint.URL)
+		if err != nil {
+			return nil, err
+		}
+		weight := endpoint.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		pool.endpoints = append(pool.endpoints, &upstreamEndpoint{baseURL: baseURL, weight: weight, healthy: true})
+		pool.publish(pool.endpoints[len(pool.endpoints)-1])
+	}
+	upstreamPools[target.URL] = pool
+
+	if pool.settings.HealthCheck != nil {
+		go pool.runHealthChecks()
+	}
+	return pool, nil
+}
+
+// pick chooses an endpoint that is healthy, not ejected and not tried yet. When every
+// untried endpoint is unhealthy, one of them is used anyway rather than failing outright.
+func (p *upstreamPool) pick(tried map[*upstreamEndpoint]bool) *upstreamEndpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var available, untried []*upstreamEndpoint
+	for _, endpoint := range p.endpoints {
+		if tried[endpoint] {
+			continue
+		}
+		untried = append(untried, endpoint)
+		if endpoint.healthy && now.After(endpoint.ejectedUntil) {
+			available = append(available, endpoint)
+		}
+	}
+	if len(available) == 0 {
+		available = untried
+	}
+	if len(available) == 0 {
+		return nil
+	}
+
+	var chosen *upstreamEndpoint
+	switch p.settings.Strategy {
+	case strategyLeastConnections:
+		for _, endpoint := range available {
+			if chosen == nil || endpoint.active < chosen.active {
+				chosen = endpoint
+			}
+		}
+	case strategyWeighted:
+		// Smooth weighted round-robin.
+		total := 0
+		for _, endpoint := range available {
+			endpoint.current += endpoint.weight
+			total += endpoint.weight
+			if chosen == nil || endpoint.current > chosen.current {
+				chosen = endpoint
+			}
+		}
+		chosen.current -= total
+	default:
+		chosen = available[p.next%len(available)]
+		p.next++
+	}
+
+	chosen.active++
+	return chosen
+}
+
+// release records the outcome of a call to an endpoint. Consecutive failures eject the
+// endpoint for a while.
+func (p *upstreamPool) release(endpoint *upstreamEndpoint, failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	endpoint.active--
+	if !failed {
+		endpoint.failures = 0
+		if !endpoint.ejectedUntil.IsZero() && time.Now().After(endpoint.ejectedUntil) {
+			endpoint.ejectedUntil = time.Time{}
+			p.publish(endpoint)
+		}
+		return
+	}
+
+	endpoint.failures++
+	ejection := p.settings.OutlierEjection
+	threshold, duration := defaultEjectionFailures, defaultEjectionDuration
+	if ejection != nil {
+		if ejection.ConsecutiveFailures > 0 {
+			threshold = ejection.ConsecutiveFailures
+		}
+		if ejection.EjectionDuration > 0 {
+			duration = ejection.EjectionDuration.Duration()
+		}
+	}
+	if endpoint.failures >= threshold {
+		endpoint.failures = 0
+		endpoint.ejectedUntil = time.Now().Add(duration)
+		fmt.Printf("UPSTREAM %s ejected for %s\n", endpoint.baseURL, duration)
+		p.publish(endpoint)
+	}
+}
+
+// runHealthChecks checks every endpoint at the configured interval.
+func (p *upstreamPool) runHealthChecks() {
+	interval := p.settings.HealthCheck.Interval.Duration()
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+	for {
+		for _, endpoint := range p.endpoints {
+			healthy := p.checkHealth(endpoint)
+			p.mu.Lock()
+			if endpoint.healthy != healthy {
+				fmt.Printf("UPSTREAM %s healthy: %t\n", endpoint.baseURL, healthy)
+			}
+			endpoint.healthy = healthy
+			p.publish(endpoint)
+			p.mu.Unlock()
+		}
+		time.Sleep(interval)
+	}
+}
+
+// checkHealth calls the health check path of an endpoint.
+func (p *upstreamPool) checkHealth(endpoint *upstreamEndpoint) bool {
+	healthCheck := p.settings.HealthCheck
+	timeout := healthCheck.Timeout.Duration()
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	checkURL := endpoint.baseURL.JoinPath(healthCheck.Path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, checkURL.String(), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	if len(healthCheck.ExpectedStatus) == 0 {
+		return resp.StatusCode >= 200 && resp.StatusCode < 300
+	}
+	for _, status := range healthCheck.ExpectedStatus {
+		if status == resp.StatusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// publish updates the state metric of an endpoint. The caller holds p.mu or owns p.
+func (p *upstreamPool) publish(endpoint *upstreamEndpoint) {
+	state := "healthy"
+	if !endpoint.healthy {
+		state = "unhealthy"
+	} else if time.Now().Before(endpoint.ejectedUntil) {
+		state = "ejected"
+	}
+	value := new(expvar.String)
+	value.Set(state)
+	upstreamStateMetric.Set(endpoint.baseURL.String(), value)
+}
+
+// upstreamURL replaces the scheme and host of the target URL with the endpoint's base URL,
+// keeping the path and query of the target URL after the base path.
+func upstreamURL(targetURL string, endpoint *upstreamEndpoint) (string, error) {
+	parsed, err := url.Parse(targetURL)
+	if err != nil {
+		return "", err
+	}
+	result := *endpoint.baseURL
+	result.Path = endpoint.baseURL.JoinPath(parsed.Path).Path
+	result.RawQuery = parsed.RawQuery
+	return result.String(), nil
+}
+
+// doUpstreamRequest performs one attempt against the target. With upstream endpoints, an
+// endpoint that cannot be reached is ejected from this attempt and the next one is tried.
+func doUpstreamRequest(client *http.Client, target conf.APITarget, reqBody []byte, headers http.Header, r *http.Request, result *targetResult) (int, error) {
+	pool, err := targetUpstreamPool(target, client)
+	if err != nil {
+		return 0, err
+	}
+	if pool == nil {
+		return doTargetRequest(client, target, target.URL, reqBody, headers, r, result)
+	}
+
+	tried := make(map[*upstreamEndpoint]bool)
+	lastErr := error(&transportError{class: transportErrorRefused, err: errNoUpstream})
+	for {
+		endpoint := pool.pick(tried)
+		if endpoint == nil {
+			return 0, lastErr
+		}
+		tried[endpoint] = true
+
+		targetURL, err := upstreamURL(target.URL, endpoint)
+		if err != nil {
+			pool.release(endpoint, true)
+			return 0, err
+		}
+		code, err := doTargetRequest(client, target, targetURL, reqBody, headers, r, result)
+		pool.release(endpoint, err != nil || code >= 500)
+
+		// A response is final. Only fail over when the request cannot have reached the
+		// endpoint, or when sending it again is safe.
+		var tErr *transportError
+		if err == nil || !errors.As(err, &tErr) || !canFailOver(target, tErr.class) || r.Context().Err() != nil {
+			return code, err
+		}
+		fmt.Printf("UPSTREAM %s failed (%s), trying next endpoint\n", endpoint.baseURL, tErr.class)
+		lastErr = err
+	}
+}
+
+// canFailOver reports whether a call that failed with a transport error class may be sent
+// to the next endpoint. A refused connection or a failed DNS lookup never reached the
+// endpoint; other failures, such as timeouts, may have, so only idempotent or explicitly
+// retryable calls are repeated.
+func canFailOver(target conf.APITarget, class string) bool {
+	switch class {
+	case transportErrorRefused, transportErrorDNS:
+		return true
+	case transportErrorParse:
+		return false
+	}
+	return isIdempotentMethod(target.Method) || (target.Retry != nil && target.Retry.RetryNonIdempotent)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"fmt"
+)
+
+// validateConfig rejects settings that would make an API mapping less strict than written.
+func validateConfig(cfg conf.Configuration) error {
+	if cfg.CORS != nil {
+		if err := validateCORS(cfg.CORS); err != nil {
+			return err
+		}
+	}
+	for _, endpoint := range cfg.APIMappings {
+		if endpoint.CORS != nil {
+			if err := validateCORS(endpoint.CORS); err != nil {
+				return fmt.Errorf("API mapping %s: %w", endpoint.Name, err)
+			}
+		}
+		if err := validateEndpointSigning(endpoint); err != nil {
+			return fmt.Errorf("API mapping %s: %w", endpoint.Name, err)
+		}
+		if endpoint.Cache != nil {
+			if err := validateCache(endpoint.Cache); err != nil {
+				return fmt.Errorf("API mapping %s: %w", endpoint.Name, err)
+			}
+		}
+		for _, step := range endpoint.Steps {
+			if step.When == nil {
+				continue
+			}
+			if err := validateCondition(*step.When); err != nil {
+				return fmt.Errorf("API mapping %s: step %s: %w", endpoint.Name, step.Name, err)
+			}
+		}
+		if endpoint.Mock != nil {
+			for _, fixture := range endpoint.Mock.Fixtures {
+				if fixture.When == nil {
+					continue
+				}
+				if err := validateCondition(*fixture.When); err != nil {
+					return fmt.Errorf("API mapping %s: fixture %s: %w", endpoint.Name, fixture.Name, err)
+				}
+			}
+		}
+		if endpoint.Policy != nil {
+			if err := validatePolicy(endpoint.Policy); err != nil {
+				return fmt.Errorf("API mapping %s: %w", endpoint.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateEndpointSigning checks the signing settings of an API mapping's target, steps,
+// branches and callbacks.
+func validateEndpointSigning(endpoint conf.APIEndpoint) error {
+	check := func(call string, signing *conf.RequestSigning) error {
+		if signing == nil {
+			return nil
+		}
+		if err := validateSigning(signing); err != nil {
+			return fmt.Errorf("%s: %w", call, err)
+		}
+		return nil
+	}
+
+	if err := check("target", endpoint.Target.Signing); err != nil {
+		return err
+	}
+	for _, step := range endpoint.Steps {
+		if err := check("step "+step.Name, step.Target.Signing); err != nil {
+			return err
+		}
+	}
+	if endpoint.FanOut != nil {
+		for _, branch := range endpoint.FanOut.Branches {
+			if err := check("branch "+branch.Name, branch.Target.Signing); err != nil {
+				return err
+			}
+		}
+	}
+	if endpoint.Async != nil {
+		return check("callback", endpoint.Async.Signing)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	conf "api-mapping-customization-guide/cmd/config"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// xmlElement is an element being collected while parsing an XML document.
+type xmlElement struct {
+	name     string
+	attrs    []xml.Attr
+	children map[string]interface{}
+	text     strings.Builder
+}
+
+// parseXML converts an XML document into a tree of maps, slices and strings so that it
+// can be queried with the same paths as a JSON body. Namespace prefixes are dropped,
+// attributes are stored under "@name", repeated elements become arrays and the text of
+// an element that also has attributes or children is stored under "#text".
+func parseXML(data []byte) (map[string]interface{}, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var (
+		stack []*xmlElement
+		root  map[string]interface{}
+	)
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			stack = append(stack, &xmlElement{name: t.Name.Local, attrs: t.Attr})
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			}
+		case xml.EndElement:
+			element := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			value := element.value()
+			if len(stack) == 0 {
+				root = map[string]interface{}{element.name: value}
+				continue
+			}
+			stack[len(stack)-1].addChild(element.name, value)
+		}
+	}
+
+	if root == nil {
+		return nil, errors.New("no XML root element found")
+	}
+	return root, nil
+}
+
+// addChild adds a child value, turning repeated elements into an array.
+func (e *xmlElement) addChild(name string, value interface{}) {
+	if e.children == nil {
+		e.children = make(map[string]interface{})
+	}
+	existing, ok := e.children[name]
+	if !ok {
+		e.children[name] = value
+		return
+	}
+	if values, isArray := existing.([]interface{}); isArray {
+		e.children[name] = append(values, value)
+		return
+	}
+	e.children[name] = []interface{}{existing, value}
+}
+
+// value returns the element as a plain string when it only holds text, or as a map otherwise.
+func (e *xmlElement) value() interface{} {
+	text := strings.TrimSpace(e.text.String())
+	var attrs []xml.Attr
+	for _, attr := range e.attrs {
+		// Namespace declarations are not data.
+		if attr.Name.Space == "xmlns" || attr.Name.Local == "xmlns" {
+			continue
+		}
+		attrs = append(attrs, attr)
+	}
+	if len(e.children) == 0 && len(attrs) == 0 {
+		return text
+	}
+
+	result := make(map[string]interface{})
+	for key, value := range e.children {
+		result[key] = value
+	}
+	for _, attr := range attrs {
+		result["@"+attr.Name.Local] = attr.Value
+	}
+	if text != "" {
+		result["#text"] = text
+	}
+	return result
+}
+
+// writeXMLElement renders a mapped value as an XML element. Keys starting with "@" become
+// attributes and "#text" becomes the element text. Child elements follow the key order
+// recorded for the mapping template, remaining keys are written in alphabetical order.
+func writeXMLElement(b *strings.Builder, name string, value interface{}, path string, order map[string][]string) {
+	switch v := value.(type) {
+	case []interface{}:
+		// Arrays are written as repeated elements.
+		for i, item := range v {
+			writeXMLElement(b, name, item, conf.JoinPath(path, strconv.Itoa(i)), order)
+		}
+	case map[string]interface{}:
+		b.WriteString("<" + name)
+		for _, key := range orderedKeys(v, path, order) {
+			if strings.HasPrefix(key, "@") {
+				b.WriteString(" " + key[1:] + `="`)
+				_ = xml.EscapeText(b, []byte(xmlText(v[key])))
+				b.WriteString(`"`)
+			}
+		}
+		b.WriteString(">")
+		if text, ok := v["#text"]; ok {
+			_ = xml.EscapeText(b, []byte(xmlText(text)))
+		}
+		for _, key := range orderedKeys(v, path, order) {
+			if !strings.HasPrefix(key, "@") && key != "#text" {
+				writeXMLElement(b, key, v[key], conf.JoinPath(path, key), order)
+			}
+		}
+		b.WriteString("</" + name + ">")
+	default:
+		b.WriteString("<" + name + ">")
+		_ = xml.EscapeText(b, []byte(xmlText(v)))
+		b.WriteString("</" + name + ">")
+	}
+}
+
+// orderedKeys returns the keys of a mapped object in template order.
+func orderedKeys(m map[string]interface{}, path string, order map[string][]string) []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, key := range order[path] {
+		if _, ok := m[key]; ok {
+			keys = append(keys, key)
+			seen[key] = true
+		}
+	}
+
+	var rest []string
+	for key := range m {
+		if !seen[key] {
+			rest = append(rest, key)
+		}
+	}
+	sort.Strings(rest)
+	return append(keys, rest...)
+}
+
+// writeXMLNamespaces renders namespace declarations as attributes, sorted by prefix.
+func writeXMLNamespaces(b *strings.Builder, namespaces map[string]string) {
+	prefixes := make([]string, 0, len(namespaces))
+	for prefix := range namespaces {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		attr := "xmlns"
+		if prefix != "" {
+			attr += ":" + prefix
+		}
+		b.WriteString(" " + attr + `="`)
+		_ = xml.EscapeText(b, []byte(namespaces[prefix]))
+		b.WriteString(`"`)
+	}
+}
+
+// xmlText formats a mapped scalar as element or attribute text. Numbers read from a JSON
+// body are float64 and are written in full, never in exponent form.
+func xmlText(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// certsDir is where the stand-in writes the certificates the gateway needs.
+const certsDir = "certs"
+
+func main() {
+	// Generate a private CA with a server and a client certificate.
+	caCert, caKey, err := generateCA()
+	if err != nil {
+		fmt.Println("Failed to generate CA:", err)
+		return
+	}
+	serverCert, err := generateLeaf("localhost", caCert, caKey, x509.ExtKeyUsageServerAuth, "server")
+	if err != nil {
+		fmt.Println("Failed to generate server certificate:", err)
+		return
+	}
+	if _, err := generateLeaf("gateway", caCert, caKey, x509.ExtKeyUsageClientAuth, "client"); err != nil {
+		fmt.Println("Failed to generate client certificate:", err)
+		return
+	}
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(caCert)
+
+	server := &http.Server{
+		Addr:    ":8443",
+		Handler: http.HandlerFunc(handleTLSRequest),
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientCAs:    clientCAs,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			MinVersion:   tls.VersionTLS12,
+		},
+	}
+
+	fmt.Println("Certificates written to", certsDir)
+	fmt.Println("Server listening on :8443 (mutual TLS)")
+	fmt.Println(server.ListenAndServeTLS("", ""))
+}
+
+type TLSResponse struct {
+	StatusCode string `json:"status_code"`
+	StatusDesc string `json:"status_desc"`
+	Client     string `json:"client"`
+}
+
+func handleTLSRequest(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received request:")
+	fmt.Printf("Method: %s\n", r.Method)
+	fmt.Printf("URL: %s\n", r.URL)
+
+	client := ""
+	if len(r.TLS.PeerCertificates) > 0 {
+		client = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	fmt.Println("Client certificate:", client)
+
+	response := TLSResponse{
+		StatusCode: "00000",
+		StatusDesc: "Success",
+		Client:     client,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// generateCA creates a self-signed CA and writes it to certs/ca.pem.
+func generateCA() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Stand-in CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writePEM("ca.pem", "CERTIFICATE", der); err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// generateLeaf creates a certificate signed by the CA and writes it to certs/<name>.pem
+// and certs/<name>-key.pem.
+func generateLeaf(commonName string, caCert *x509.Certificate, caKey *ecdsa.PrivateKey, usage x509.ExtKeyUsage, name string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := writePEM(name+".pem", "CERTIFICATE", der); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := writePEM(name+"-key.pem", "EC PRIVATE KEY", keyDER); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// writePEM writes a PEM block to a file in certsDir.
+func writePEM(fileName, blockType string, der []byte) error {
+	if err := os.MkdirAll(certsDir, 0o755); err != nil {
+		return err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	return os.WriteFile(filepath.Join(certsDir, fileName), data, 0o600)
+}
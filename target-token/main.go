@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client credentials accepted by the stand-in token server.
+const (
+	clientID     = "gateway"
+	clientSecret = "gateway-secret"
+	tokenTTL     = 60 * time.Second
+)
+
+// tokens holds the issued access tokens and when they expire.
+var (
+	tokensMu sync.Mutex
+	tokens   = make(map[string]time.Time)
+)
+
+func main() {
+	http.HandleFunc("/oauth2/token", handleTokenRequest)
+	http.HandleFunc("/oauth2/revoke", handleRevokeRequest)
+	http.HandleFunc("/protected/simswap", handleProtectedRequest)
+	fmt.Println("Server listening on :8090")
+	http.ListenAndServe(":8090", nil)
+}
+
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+type ProtectedResponse struct {
+	StatusCode string `json:"status_code"`
+	StatusDesc string `json:"status_desc"`
+}
+
+// handleTokenRequest issues a token for the client credentials grant.
+func handleTokenRequest(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received token request")
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if r.PostForm.Get("grant_type") != "client_credentials" || id != clientID || secret != clientSecret {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":"invalid_client"}`)
+		return
+	}
+
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	token := hex.EncodeToString(b)
+	tokensMu.Lock()
+	tokens[token] = time.Now().Add(tokenTTL)
+	tokensMu.Unlock()
+	fmt.Println("Issued token:", token, "scope:", r.PostForm.Get("scope"))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(tokenTTL.Seconds()),
+	})
+}
+
+// handleRevokeRequest revokes every token, so the next protected call gets a 401.
+func handleRevokeRequest(w http.ResponseWriter, r *http.Request) {
+	tokensMu.Lock()
+	tokens = make(map[string]time.Time)
+	tokensMu.Unlock()
+	fmt.Println("Revoked all tokens")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleProtectedRequest answers like the SIM swap target when the bearer token is valid.
+func handleProtectedRequest(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	tokensMu.Lock()
+	expires, ok := tokens[token]
+	tokensMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ok || time.Now().After(expires) {
+		fmt.Println("Rejected token:", token)
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":"invalid_token"}`)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ProtectedResponse{
+		StatusCode: "00000",
+		StatusDesc: "Success",
+	})
+}